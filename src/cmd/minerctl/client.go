@@ -0,0 +1,136 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mininghq/rpcproto/rpcproto"
+	"google.golang.org/grpc"
+)
+
+// unixEndpointPrefix marks a Manager API endpoint as a Unix socket path
+const unixEndpointPrefix = "unix:"
+
+// callTimeout is how long we wait for a single Manager API call
+const callTimeout = time.Second * 30
+
+// managerClient is a connection to the Manager API
+type managerClient struct {
+	rpcproto.ManagerServiceClient
+	conn *grpc.ClientConn
+}
+
+// newManagerClient connects to the Manager API on the endpoint. TCP
+// endpoints require the token from the token file
+func newManagerClient(endpoint string, tokenFile string) (*managerClient, error) {
+	network := "tcp"
+	address := endpoint
+	dialOptions := []grpc.DialOption{grpc.WithInsecure()}
+	if strings.HasPrefix(endpoint, unixEndpointPrefix) {
+		// The controller checks the user of Unix socket connections
+		network = "unix"
+		address = strings.TrimPrefix(endpoint, unixEndpointPrefix)
+	} else {
+		token, err := readToken(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(tokenCredentials(token)))
+	}
+	dialOptions = append(dialOptions, grpc.WithDialer(
+		func(address string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(network, address, timeout)
+		}))
+
+	conn, err := grpc.Dial(address, dialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to the Manager API at %s: %s", endpoint, err)
+	}
+	return &managerClient{
+		ManagerServiceClient: rpcproto.NewManagerServiceClient(conn),
+		conn:                 conn,
+	}, nil
+}
+
+// Close the connection
+func (client *managerClient) Close() error {
+	return client.conn.Close()
+}
+
+// callContext returns the context for a single call
+func callContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), callTimeout)
+}
+
+// readToken reads the Manager API token, without a token file the one of
+// the installation minerctl runs from is used
+func readToken(tokenFile string) (string, error) {
+	if tokenFile == "" {
+		// The structure of the installation is the same as the
+		// controller's, the token is in the folder above the version
+		// /miner-controller/{version}/minerctl
+		executablePath, err := os.Executable()
+		if err != nil {
+			return "", fmt.Errorf("Unable to find executing path: %s", err)
+		}
+		tokenFile = filepath.Join(
+			filepath.Dir(filepath.Dir(executablePath)),
+			"manager_token")
+	}
+	tokenBytes, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf(
+			"Unable to read Manager API token, set it with --token-file: %s",
+			err)
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+	if token == "" {
+		return "", errors.New("The Manager API token file is empty")
+	}
+	return token, nil
+}
+
+// tokenCredentials sends the Manager API token with every call
+type tokenCredentials string
+
+// GetRequestMetadata returns the token metadata for a call
+func (token tokenCredentials) GetRequestMetadata(
+	ctx context.Context,
+	uri ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + string(token),
+	}, nil
+}
+
+// RequireTransportSecurity is false, the Manager API is local only
+func (tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
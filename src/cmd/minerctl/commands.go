@@ -0,0 +1,286 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mininghq/rpcproto/rpcproto"
+)
+
+// runStatus prints the rig state and the active miners
+func runStatus(client *managerClient, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.Parse(args)
+
+	ctx, cancel := callContext()
+	defer cancel()
+	state, err := client.GetState(ctx, &rpcproto.StateRequest{})
+	if err != nil {
+		return fmt.Errorf("Unable to get the rig state: %s", err)
+	}
+	miners, err := client.ListMiners(ctx, &rpcproto.ListMinersRequest{})
+	if err != nil {
+		return fmt.Errorf("Unable to list the miners: %s", err)
+	}
+
+	fmt.Printf("State: %s\n\n", state.State.String())
+	if len(miners.Miners) == 0 {
+		fmt.Println("No active miners")
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "KEY\tTYPE\tVERSION\tSTATE\tPID\tUPTIME\tAPI PORT")
+	for _, info := range miners.Miners {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%s\t%d\n",
+			info.Key,
+			info.Type,
+			info.Version,
+			info.State,
+			info.PID,
+			time.Duration(info.UptimeSeconds)*time.Second,
+			info.APIPort)
+	}
+	return table.Flush()
+}
+
+// runInfo prints the rig information received from MiningHQ
+func runInfo(client *managerClient, args []string) error {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	flags.Parse(args)
+
+	ctx, cancel := callContext()
+	defer cancel()
+	info, err := client.GetInfo(ctx, &rpcproto.RigInfoRequest{})
+	if err != nil {
+		return fmt.Errorf("Unable to get the rig info: %s", err)
+	}
+	fmt.Printf("Name: %s\nLink: %s\n", info.Name, info.Link)
+
+	warnings, err := client.GetWarnings(ctx, &rpcproto.WarningsRequest{})
+	if err != nil {
+		return fmt.Errorf("Unable to get the warnings: %s", err)
+	}
+	for _, warning := range warnings.Warnings {
+		fmt.Printf("Warning: %s %s\n", warning.MinerKey, warning.Reason)
+	}
+	return nil
+}
+
+// runStats prints the stats of the miners as a table or JSON
+func runStats(client *managerClient, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the stats as JSON")
+	flags.Parse(args)
+
+	ctx, cancel := callContext()
+	defer cancel()
+	stats, err := client.GetStats(ctx, &rpcproto.StatsRequest{})
+	if err != nil {
+		return fmt.Errorf("Unable to get the stats: %s", err)
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	if len(stats.Stats) == 0 {
+		fmt.Println("No stats available")
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "KEY\tHASHRATE\t60S\t15M\tACCEPTED\tREJECTED\tDIFFICULTY\tPOOL\tPING")
+	for _, minerStats := range stats.Stats {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%dms\n",
+			minerStats.Key,
+			humanizeHashrate(minerStats.Hashrate),
+			humanizeHashrate(minerStats.Hashrate60S),
+			humanizeHashrate(minerStats.Hashrate15M),
+			minerStats.AcceptedShares,
+			minerStats.RejectedShares,
+			minerStats.CurrentDifficulty,
+			minerStats.Pool,
+			minerStats.PoolPing)
+	}
+	return table.Flush()
+}
+
+// runLogs prints the buffered miner logs, with --follow the new lines are
+// printed until interrupted
+func runLogs(client *managerClient, args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("follow", false, "Keep printing new lines")
+	minerKey := flags.String("miner", "", "Only print the logs of this miner")
+	flags.Parse(args)
+
+	if *follow {
+		return followLogs(client, *minerKey)
+	}
+
+	ctx, cancel := callContext()
+	defer cancel()
+	logs, err := client.GetLogs(ctx, &rpcproto.LogsRequest{})
+	if err != nil {
+		return fmt.Errorf("Unable to get the logs: %s", err)
+	}
+	for _, minerLog := range logs.MinerLogs {
+		if *minerKey != "" && minerLog.Key != *minerKey {
+			continue
+		}
+		for _, line := range minerLog.Logs {
+			printLogLine(*minerKey, minerLog.Key, line)
+		}
+	}
+	return nil
+}
+
+// followLogs prints the miner output as it is written until interrupted
+func followLogs(client *managerClient, minerKey string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalChannel
+		cancel()
+	}()
+
+	stream, err := client.TailLogs(ctx, &rpcproto.TailLogsRequest{
+		MinerKey: minerKey,
+		Backlog:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to follow the logs: %s", err)
+	}
+	for {
+		logLine, err := stream.Recv()
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to follow the logs: %s", err)
+		}
+		if logLine.Dropped > 0 {
+			fmt.Fprintf(os.Stderr, "minerctl: %d lines skipped, output is too slow\n", logLine.Dropped)
+		}
+		printLogLine(minerKey, logLine.MinerKey, logLine.Line)
+	}
+}
+
+// printLogLine prints a line of miner output, prefixed with the miner key
+// unless only the logs of a single miner are printed
+func printLogLine(filterKey string, minerKey string, line string) {
+	if filterKey != "" {
+		fmt.Println(line)
+		return
+	}
+	fmt.Printf("[%s] %s\n", minerKey, line)
+}
+
+// runStart starts mining, or a single miner
+func runStart(client *managerClient, args []string) error {
+	flags := flag.NewFlagSet("start", flag.ExitOnError)
+	minerKey := flags.String("miner", "", "Only start this miner")
+	flags.Parse(args)
+
+	if *minerKey != "" {
+		ctx, cancel := callContext()
+		defer cancel()
+		info, err := client.StartMiner(ctx, &rpcproto.MinerControlRequest{Key: *minerKey})
+		if err != nil {
+			return fmt.Errorf("Unable to start miner %s: %s", *minerKey, err)
+		}
+		fmt.Printf("Miner %s: %s\n", info.Key, info.State)
+		return nil
+	}
+	return setState(client, rpcproto.MinerState_StartMining)
+}
+
+// runStop stops mining, or a single miner
+func runStop(client *managerClient, args []string) error {
+	flags := flag.NewFlagSet("stop", flag.ExitOnError)
+	minerKey := flags.String("miner", "", "Only stop this miner")
+	flags.Parse(args)
+
+	if *minerKey != "" {
+		ctx, cancel := callContext()
+		defer cancel()
+		info, err := client.StopMiner(ctx, &rpcproto.MinerControlRequest{Key: *minerKey})
+		if err != nil {
+			return fmt.Errorf("Unable to stop miner %s: %s", *minerKey, err)
+		}
+		fmt.Printf("Miner %s: %s\n", info.Key, info.State)
+		return nil
+	}
+	return setState(client, rpcproto.MinerState_StopMining)
+}
+
+// runPause pauses mining
+func runPause(client *managerClient, args []string) error {
+	flags := flag.NewFlagSet("pause", flag.ExitOnError)
+	flags.Parse(args)
+	return setState(client, rpcproto.MinerState_PauseMining)
+}
+
+// runResume resumes mining
+func runResume(client *managerClient, args []string) error {
+	flags := flag.NewFlagSet("resume", flag.ExitOnError)
+	flags.Parse(args)
+	return setState(client, rpcproto.MinerState_ResumeMining)
+}
+
+// setState requests the rig to enter the state and prints the new state
+func setState(client *managerClient, state rpcproto.MinerState) error {
+	ctx, cancel := callContext()
+	defer cancel()
+	response, err := client.SetState(ctx, &rpcproto.StateRequest{State: state})
+	if err != nil {
+		return fmt.Errorf("Unable to set the rig state to %s: %s", state.String(), err)
+	}
+	fmt.Printf("State: %s\n", response.State.String())
+	return nil
+}
+
+// newTable returns a writer that aligns tab separated columns
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+}
+
+// humanizeHashrate returns the hashrate in H/s, KH/s or MH/s
+func humanizeHashrate(hashrate float64) string {
+	if hashrate > 1000000 {
+		return fmt.Sprintf("%.2f MH/s", hashrate/1000000)
+	} else if hashrate > 1000 {
+		return fmt.Sprintf("%.2f KH/s", hashrate/1000)
+	}
+	return fmt.Sprintf("%.2f H/s", hashrate)
+}
@@ -0,0 +1,117 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// minerctl is a command-line client for the Manager API of the miner
+// controller, it allows rigs to be inspected and controlled from a shell
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// Config holds the environment variables for minerctl, they are the same
+// as the controller's
+type Config struct {
+	// ManagerEndpoint is the gRPC API endpoint of the controller, use
+	// 'unix:<path>' for a Unix socket
+	ManagerEndpoint string `split_words:"true" default:"localhost:64630"`
+	// ManagerTokenFile is the token file for TCP endpoints, it defaults to
+	// the manager_token file of the installation minerctl runs from
+	ManagerTokenFile string `split_words:"true"`
+}
+
+// command is a minerctl subcommand
+type command struct {
+	name        string
+	description string
+	run         func(client *managerClient, args []string) error
+}
+
+// commands are the supported subcommands
+var commands = []command{
+	{"status", "Show the rig state and the active miners", runStatus},
+	{"info", "Show the rig information from MiningHQ", runInfo},
+	{"stats", "Show the miner stats [--json]", runStats},
+	{"logs", "Show the miner logs [--follow] [--miner KEY]", runLogs},
+	{"start", "Start mining, or a single miner with --miner KEY", runStart},
+	{"stop", "Stop mining, or a single miner with --miner KEY", runStop},
+	{"pause", "Pause mining", runPause},
+	{"resume", "Resume mining", runResume},
+}
+
+func main() {
+	var config Config
+	err := envconfig.Process("", &config)
+	if err != nil {
+		fail(fmt.Errorf("Unable to process config: %s", err))
+	}
+
+	flag.StringVar(&config.ManagerEndpoint, "endpoint", config.ManagerEndpoint,
+		"Manager API endpoint, 'unix:<path>' for a Unix socket")
+	flag.StringVar(&config.ManagerTokenFile, "token-file", config.ManagerTokenFile,
+		"Manager API token file for TCP endpoints")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		client, err := newManagerClient(config.ManagerEndpoint, config.ManagerTokenFile)
+		if err != nil {
+			fail(err)
+		}
+		err = cmd.run(client, flag.Args()[1:])
+		client.Close()
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// usage prints the help for minerctl
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: minerctl [flags] <command> [command flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// fail prints the error and exits
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "minerctl: %s\n", err)
+	os.Exit(1)
+}
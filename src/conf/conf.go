@@ -42,8 +42,66 @@ const (
 	PingInterval = (PongWait * 9) / 10
 	// WriteWait is the time we'll wait for a websocket message to be sent
 	WriteWait = time.Second * 10
+	// MinStatsSubmitInterval is the shortest stats interval MiningHQ may set
+	MinStatsSubmitInterval = time.Second * 10
+	// MinerLogLines is the default number of output lines kept per miner
+	MinerLogLines = 100
+	// MaxMinerLogLines is the most output lines MiningHQ may have us keep
+	MaxMinerLogLines = 10000
+	// ErrorReportBurst is the default number of miner errors and warnings
+	// reported per miner within ErrorReportInterval
+	ErrorReportBurst = 10
+	// ErrorReportInterval is the default window for ErrorReportBurst
+	ErrorReportInterval = time.Minute
+	// WarningsMaxCount is the number of MiningHQ warnings kept for the
+	// Miner Manager
+	WarningsMaxCount = 50
+	// OutboxMaxBytes is the maximum size of the stats and errors queued
+	// on disk while MiningHQ can't be reached
+	OutboxMaxBytes = 1024 * 1024 * 20
+	// ReconnectMinBackoff is the first wait before reconnecting to MiningHQ
+	ReconnectMinBackoff = time.Second * 5
+	// ReconnectMaxBackoff is the longest wait before reconnecting to MiningHQ
+	ReconnectMaxBackoff = time.Minute * 5
 	// DiscordAppID is used to submit Discord stats
 	DiscordAppID = "530821687864983554"
+	// MinerUpdateCheckInterval defines how long to wait between checking
+	// for miner updates while a miner is running
+	MinerUpdateCheckInterval = time.Hour
+	// MinerStopTimeout is the time we'll wait for a miner to exit after
+	// SIGTERM before it is killed
+	MinerStopTimeout = time.Second * 10
+	// MinerRestartMinBackoff is the wait before restarting a crashed miner
+	MinerRestartMinBackoff = time.Second * 5
+	// MinerRestartMaxBackoff is the longest wait before restarting a crashed miner
+	MinerRestartMaxBackoff = time.Minute * 5
+	// MinerStartupGracePeriod is how long new miners must keep running
+	// before an assignment is considered applied
+	MinerStartupGracePeriod = time.Second * 10
+	// DownloadProgressInterval is how often the download progress of a
+	// miner is reported
+	DownloadProgressInterval = time.Second * 2
+	// ReconcileInterval is how often the miners are compared with the
+	// desired state
+	ReconcileInterval = time.Second * 30
+	// ReconcileMaxAPIFailures is the number of consecutive failed API
+	// checks before a miner is restarted
+	ReconcileMaxAPIFailures = 3
+	// MinerStableRuntime is how long a miner must run before the restart
+	// backoff is reset
+	MinerStableRuntime = time.Minute * 10
+	// MinerCrashLoopCount is the number of crashes within MinerCrashLoopWindow
+	// after which we stop restarting a miner
+	MinerCrashLoopCount = 5
+	// MinerCrashLoopWindow is the window in which crashes are counted
+	MinerCrashLoopWindow = time.Minute * 15
+	// MinerCrashLogLines is the number of log lines included in crash reports
+	MinerCrashLogLines = 10
+	// MinerStatsTimeout is the time we'll wait for a miner's stats API
+	MinerStatsTimeout = time.Second * 5
+	// StreamBufferSize is the number of messages buffered for each Manager
+	// API stream, messages are dropped for clients that fall further behind
+	StreamBufferSize = 256
 )
 
 // Dev
@@ -22,123 +22,764 @@
 package ctl
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/gogo/protobuf/proto"
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/mininghq/miner-controller/src/mhq"
 	"github.com/mininghq/miner-controller/src/miner"
 	"github.com/mininghq/rpcproto/rpcproto"
 	"github.com/sirupsen/logrus"
 )
 
-// handleAssignment handles new mining assignments from MiningHQ
-func (ctl *Ctl) handleAssignment(assignment *rpcproto.RigAssignmentRequest) error {
+// errAssignmentSuperseded is returned when a newer assignment was
+// received before the assignment was applied
+var errAssignmentSuperseded = errors.New("A newer rig assignment was received")
+
+// errAssignmentReplaced is returned when an assignment is applied again
+// after a newer assignment replaced it
+var errAssignmentReplaced = errors.New("The assignment was replaced by a newer one")
+
+// assignmentChanges lists the miner keys touched by an assignment
+type assignmentChanges struct {
+	// started are the miners that were not running before
+	started []string
+	// reconfigured are the miners restarted with a changed config
+	reconfigured []string
+	// stopped are the miners no longer in the assignment
+	stopped []string
+	// unchanged are the miners that kept running
+	unchanged []string
+}
+
+// applyAssignment applies the assignment and sends the result to MiningHQ
+func (ctl *Ctl) applyAssignment(
+	assignment *rpcproto.RigAssignmentRequest,
+	sequence uint64) {
+
+	changes, err := ctl.applyLatestAssignment(assignment, sequence)
+	if err == errAssignmentSuperseded {
+		ctl.log.Info("Skipping rig assignment, a newer assignment was received")
+		response := rpcproto.Packet{
+			Method: rpcproto.Method_RigAssignment,
+			Params: &rpcproto.Packet_RigAssignmentResponse{
+				RigAssignmentResponse: &rpcproto.RigAssignmentResponse{
+					Status:     "RigAssignment superseded",
+					StatusCode: http.StatusConflict,
+					Reason:     err.Error(),
+				},
+			},
+		}
+		err = ctl.sendMessage(&response)
+		if err != nil {
+			ctl.log.Errorf("Unable to send RigAssignmentResponse to MiningHQ: %s", err)
+		}
+		return
+	}
+	if err != nil {
+		ctl.log.Errorf("Unable to update mining assignment: %s", err)
+		// Send response message
+		response := rpcproto.Packet{
+			Method: rpcproto.Method_RigAssignment,
+			Params: &rpcproto.Packet_RigAssignmentResponse{
+				RigAssignmentResponse: &rpcproto.RigAssignmentResponse{
+					Status:     "RigAssignment error",
+					StatusCode: http.StatusInternalServerError,
+					Reason:     fmt.Sprintf("Unable to update rig assignment: %s", err),
+				},
+			},
+		}
+		err = ctl.sendMessage(&response)
+		if err != nil {
+			ctl.log.Errorf("Unable to send RigAssignmentResponse to MiningHQ: %s", err)
+		}
+		return
+	}
+	ctl.log.Info("Rig has been reconfigured with new mining assignment")
+
+	var minerVersions []string
+	ctl.mutex.Lock()
+	for _, miner := range ctl.miners {
+		minerVersions = append(minerVersions, fmt.Sprintf("%s %s", miner.GetType(), miner.GetVersion()))
+	}
+	ctl.mutex.Unlock()
+
+	// Send response message
+	response := rpcproto.Packet{
+		Method: rpcproto.Method_RigAssignment,
+		Params: &rpcproto.Packet_RigAssignmentResponse{
+			RigAssignmentResponse: &rpcproto.RigAssignmentResponse{
+				Status:             "Ok",
+				StatusCode:         http.StatusOK,
+				MinerVersions:      minerVersions,
+				StartedMiners:      changes.started,
+				ReconfiguredMiners: changes.reconfigured,
+				StoppedMiners:      changes.stopped,
+				UnchangedMiners:    changes.unchanged,
+			},
+		},
+	}
+	err = ctl.sendMessage(&response)
+	if err != nil {
+		ctl.log.Errorf("Unable to send RigAssignmentResponse to MiningHQ: %s", err)
+	}
+}
+
+// applyLatestAssignment applies the assignment unless a newer assignment
+// was received after it. The assignments are applied in their own
+// goroutines, an older assignment must never replace a newer one
+func (ctl *Ctl) applyLatestAssignment(
+	assignment *rpcproto.RigAssignmentRequest,
+	sequence uint64) (assignmentChanges, error) {
+	ctl.assignmentMutex.Lock()
+	defer ctl.assignmentMutex.Unlock()
+
+	if sequence != atomic.LoadUint64(&ctl.assignmentSequence) {
+		return assignmentChanges{}, errAssignmentSuperseded
+	}
+	return ctl.handleAssignment(assignment)
+}
+
+// reapplyAssignment applies a copy of the current assignment again to
+// start the miners that are not running. It is skipped with
+// errAssignmentReplaced if the assignment changed since it was copied,
+// the newer assignment must not be overwritten
+func (ctl *Ctl) reapplyAssignment(
+	assignment *rpcproto.RigAssignmentRequest) (assignmentChanges, error) {
+	ctl.assignmentMutex.Lock()
+	defer ctl.assignmentMutex.Unlock()
+
 	ctl.mutex.Lock()
-	defer ctl.mutex.Unlock()
+	currentAssignment := ctl.currentAssignment
+	ctl.mutex.Unlock()
+	if assignment == nil || assignment != currentAssignment {
+		return assignmentChanges{}, errAssignmentReplaced
+	}
+	return ctl.handleAssignment(assignment)
+}
+
+// handleAssignment handles new mining assignments from MiningHQ. Only the
+// miners whose config changed are restarted, unchanged miners keep running
+//
+// The assignment is applied in phases. Every config is validated and
+// rendered first, the running miners are only touched once that worked.
+// If the new miners fail to start, the previous miners are restored
+//
+// Creating the miners may download them, ctl.mutex is only held while the
+// miners are swapped to keep the stats and the Miner Manager responsive
+func (ctl *Ctl) handleAssignment(
+	assignment *rpcproto.RigAssignmentRequest) (assignmentChanges, error) {
+	ctl.applyMutex.Lock()
+	defer ctl.applyMutex.Unlock()
 
-	var err error
+	var changes assignmentChanges
 	ctl.log.Info("Received new rig assignment")
-	// If we were mining, we need to stop all the miners and remove their
-	// config files
-	ctl.log.Debug("Stopping all miners...")
-	for _, miner := range ctl.miners {
-		err = miner.Stop()
+
+	//
+	// Phase 1: Validate the assignment and create the new miners, nothing
+	// is running yet so failures don't affect the current miners
+	//
+	ctl.reportProgress(phaseValidating, "", mhq.Progress{}, "")
+	configHashes, err := validateAssignment(assignment)
+	if err != nil {
+		ctl.reportProgress(phaseFailed, "", mhq.Progress{}, err.Error())
+		return changes, err
+	}
+
+	// The miners only change while holding applyMutex, the copies stay
+	// valid until we swap the miners
+	ctl.mutex.Lock()
+	currentAssignment := ctl.currentAssignment
+	activeMiners := append([]miner.Miner(nil), ctl.miners...)
+	currentUpdaters := make(map[string]string)
+	for minerType, key := range ctl.updaters {
+		currentUpdaters[minerType] = key
+	}
+	ctl.mutex.Unlock()
+
+	// The running miners were created from the current assignment
+	runningHashes := make(map[string]string)
+	if currentAssignment != nil {
+		runningHashes, err = assignmentHashes(currentAssignment)
 		if err != nil {
-			return fmt.Errorf("Unable to stop miner (%s): %s", miner.GetType(), err)
+			ctl.reportProgress(phaseFailed, "", mhq.Progress{}, err.Error())
+			return changes, err
 		}
 	}
-	ctl.miners = nil
 
-	for i, config := range assignment.MinerConfigs {
+	configs := make(map[string]*rpcproto.MinerConfig)
+	for _, config := range assignment.MinerConfigs {
+		configs[config.GetKey()] = config
+	}
+
+	// Changed miners of the same type may be reconfigured while running,
+	// they are only replaced if that fails
+	keptMiners := make(map[string]miner.Miner)
+	reconfiguringMiners := make(map[string]miner.Miner)
+	var stoppingMiners []miner.Miner
+	for _, activeMiner := range activeMiners {
+		key := activeMiner.GetKey()
+		config, inAssignment := configs[key]
+		if inAssignment && configHashes[key] == runningHashes[key] {
+			keptMiners[key] = activeMiner
+			continue
+		}
+		if inAssignment {
+			changes.reconfigured = append(changes.reconfigured, key)
+			if activeMiner.GetType() == minerTypeForConfig(config) {
+				reconfiguringMiners[key] = activeMiner
+				continue
+			}
+		} else {
+			changes.stopped = append(changes.stopped, key)
+		}
+		stoppingMiners = append(stoppingMiners, activeMiner)
+	}
+
+	minerDir, err := getMinersDir()
+	if err != nil {
+		err = fmt.Errorf("Unable to get current executable path: %s", err)
+		ctl.reportProgress(phaseFailed, "", mhq.Progress{}, err.Error())
+		return changes, err
+	}
+
+	updaters := make(map[string]string)
+	for minerType, key := range currentUpdaters {
+		_, kept := keptMiners[key]
+		_, reconfiguring := reconfiguringMiners[key]
+		if kept || reconfiguring {
+			updaters[minerType] = key
+		}
+	}
+	var newMiners []*miner.Supervisor
+	for _, config := range assignment.MinerConfigs {
+		key := config.GetKey()
+		if _, kept := keptMiners[key]; kept {
+			changes.unchanged = append(changes.unchanged, key)
+			continue
+		}
+		if _, reconfiguring := reconfiguringMiners[key]; reconfiguring {
+			continue
+		}
+
 		ctl.log.WithFields(logrus.Fields{
-			"id": i,
+			"miner_key": key,
 		}).Debug("Configuring miner")
+		ctl.reportProgress(phaseConfiguring, key, mhq.Progress{}, "")
 
 		// TODO / NOTE: go-unattended needs an update when multiple processes attempt to
 		// update the same target. Unattended was never *meant* to be run this way
 		// but it works very well regardless. For now we only limit a single miner
-		// to check for updates.
+		// of each type to check for updates.
 		// TODO BUG: This has the side-effect of only one miner updating and
 		// restarting. The others will only be updated when they are restarted
 		// for whatever reason
 		//
 		// Only impacts split mining setups
-		//
-		// Only the first miner will check for updates
-		withUpdate := false
-		if i == 0 {
-			withUpdate = true
+		minerType := minerTypeForConfig(config)
+		_, hasUpdater := updaters[minerType]
+		if !hasUpdater {
+			updaters[minerType] = key
+		}
+
+		supervisor, err := ctl.createMiner(
+			minerDir,
+			config,
+			configHashes[key],
+			!hasUpdater)
+		if err != nil {
+			ctl.discardMiners(newMiners)
+			err = fmt.Errorf(
+				"Unable to create new miner %s (%s): %s",
+				key,
+				minerType,
+				err)
+			ctl.reportProgress(phaseFailed, key, mhq.Progress{}, err.Error())
+			return assignmentChanges{}, err
+		}
+		newMiners = append(newMiners, supervisor)
+		if !containsString(changes.reconfigured, key) {
+			changes.started = append(changes.started, key)
 		}
+	}
 
-		// TODO: Use the config.Miner specified
-		// TODO: Until we support more miners, we'll hardcode xmrig :)
+	//
+	// Phase 2: Reconfigure the changed miners, reconfiguring keeps the
+	// hashrate up. The miners that can't be reconfigured are replaced,
+	// creating the replacements may download them
+	//
+	ctl.reportProgress(phaseStarting, "", mhq.Progress{}, "")
+	var reconfiguredMiners []miner.Miner
+	for key, activeMiner := range reconfiguringMiners {
+		log := ctl.log.WithFields(logrus.Fields{
+			"miner_key":  key,
+			"miner_type": activeMiner.GetType(),
+		})
+		err = miner.ErrNotSupported
+		if reconfigurer, ok := activeMiner.(miner.Reconfigurer); ok {
+			err = reconfigurer.Reconfigure(*configs[key])
+		}
+		if err == nil {
+			log.Debug("Miner reconfigured")
+			reconfiguredMiners = append(reconfiguredMiners, activeMiner)
+			continue
+		}
+		if err != miner.ErrNotSupported {
+			log.Warningf("Unable to reconfigure miner, restarting it: %s", err)
+		}
 
-		// TODO: Change API port for each miner!
-		// TODO: Write miners and configs to the real dirs
+		supervisor, err := ctl.createMiner(
+			minerDir,
+			configs[key],
+			configHashes[key],
+			updaters[activeMiner.GetType()] == key)
+		if err != nil {
+			err = fmt.Errorf("Unable to create new miner %s: %s", key, err)
+			ctl.log.Errorf("%s, rolling back to the previous assignment", err)
+			// Nothing was stopped yet, the miners to stop keep running
+			runningMiners := make(map[string]miner.Miner)
+			for runningKey, keptMiner := range keptMiners {
+				runningMiners[runningKey] = keptMiner
+			}
+			for _, stoppingMiner := range stoppingMiners {
+				runningMiners[stoppingMiner.GetKey()] = stoppingMiner
+			}
+			ctl.mutex.Lock()
+			ctl.rollbackAssignment(runningMiners, reconfiguredMiners, nil, newMiners)
+			ctl.mutex.Unlock()
+			err = fmt.Errorf("%s. The previous assignment was restored", err)
+			ctl.reportProgress(phaseFailed, key, mhq.Progress{}, err.Error())
+			return assignmentChanges{}, err
+		}
+		// The replaced miner is stopped with the removed miners
+		stoppingMiners = append(stoppingMiners, activeMiner)
+		newMiners = append(newMiners, supervisor)
+	}
 
-		executablePath, err := os.Executable()
+	//
+	// Phase 3: Swap the miners, the removed and replaced miners are
+	// stopped and remove their config files
+	//
+	ctl.mutex.Lock()
+	if ctl.isStopping() {
+		ctl.mutex.Unlock()
+		ctl.discardMiners(newMiners)
+		return assignmentChanges{}, errors.New("The controller is shutting down")
+	}
+	for _, activeMiner := range stoppingMiners {
+		ctl.log.WithFields(logrus.Fields{
+			"miner_key":  activeMiner.GetKey(),
+			"miner_type": activeMiner.GetType(),
+		}).Debug("Stopping miner")
+		err = activeMiner.Stop()
 		if err != nil {
-			ctl.log.Fatalf("Unable to get current executable path: %s", err)
+			// The process is stopped even if removing the config failed
+			ctl.log.WithField(
+				"miner_key", activeMiner.GetKey(),
+			).Warningf("Unable to stop miner cleanly: %s", err)
 		}
+	}
 
-		// Walk up the tree to determine the correct path
-		minerDir := filepath.Dir(executablePath)
-		minerDir = filepath.Dir(minerDir)
-		minerDir = filepath.Join(minerDir, "miners")
+	for _, supervisor := range newMiners {
+		ctl.log.WithField(
+			"miner_key", supervisor.GetKey(),
+		).Debug("Starting miner with new assignment")
+		ctl.runMiner(supervisor)
+	}
+
+	// Keep the order of the assignment
+	minersByKey := make(map[string]miner.Miner)
+	for key, keptMiner := range keptMiners {
+		minersByKey[key] = keptMiner
+	}
+	for _, reconfiguredMiner := range reconfiguredMiners {
+		minersByKey[reconfiguredMiner.GetKey()] = reconfiguredMiner
+	}
+	for _, supervisor := range newMiners {
+		minersByKey[supervisor.GetKey()] = supervisor
+	}
+	ctl.miners = nil
+	for _, config := range assignment.MinerConfigs {
+		ctl.miners = append(ctl.miners, minersByKey[config.GetKey()])
+	}
+	ctl.mutex.Unlock()
 
-		// Configure miners with new assignment
-		xmrig, err := miner.NewXmrig(
-			withUpdate,
-			filepath.Join(minerDir, "xmrig"),
-			filepath.Join(minerDir, "config."+strconv.Itoa(i)+".json"),
-			*config,
-		)
+	// The miners are started together, they share the grace period
+	deadline := time.Now().Add(conf.MinerStartupGracePeriod)
+	for _, supervisor := range newMiners {
+		err = supervisor.WaitStarted(time.Until(deadline))
 		if err != nil {
-			return fmt.Errorf("Unable to create new miner (xmrig): %s", err)
+			err = fmt.Errorf(
+				"Unable to start miner %s: %s",
+				supervisor.GetKey(),
+				err)
+			ctl.mutex.Lock()
+			if !ctl.isStopping() {
+				ctl.log.Errorf("%s, rolling back to the previous assignment", err)
+				ctl.rollbackAssignment(keptMiners, reconfiguredMiners, stoppingMiners, newMiners)
+				err = fmt.Errorf("%s. The previous assignment was restored", err)
+			}
+			ctl.mutex.Unlock()
+			ctl.reportProgress(phaseFailed, supervisor.GetKey(), mhq.Progress{}, err.Error())
+			return assignmentChanges{}, err
 		}
-		xmrig.SetErrorHandler(ctl.minerErrorHandler)
+	}
+
+	// The miners kept from a paused rig must mine again
+	previousMiners := append([]miner.Miner(nil), reconfiguredMiners...)
+	for _, keptMiner := range keptMiners {
+		previousMiners = append(previousMiners, keptMiner)
+	}
+	ctl.resumeMiners(previousMiners)
+
+	ctl.mutex.Lock()
+	ctl.updaters = updaters
+	ctl.pruneErrorReports()
+	if len(ctl.miners) > 0 && ctl.currentState != rpcproto.MinerState_Mining {
+		ctl.setState(rpcproto.MinerState_Mining)
+	}
+	ctl.currentAssignment = assignment
+
+	ctl.log.WithFields(logrus.Fields{
+		"started":      changes.started,
+		"reconfigured": changes.reconfigured,
+		"stopped":      changes.stopped,
+		"unchanged":    changes.unchanged,
+	}).Info("Applied rig assignment")
 
-		ctl.miners = append(ctl.miners, xmrig)
+	// Persist the assignment to be able to resume mining after a restart
+	err = ctl.saveState()
+	if err != nil {
+		ctl.log.Warningf("Unable to save the assignment: %s", err)
+	}
+	ctl.mutex.Unlock()
+
+	ctl.reportProgress(phaseApplied, "", mhq.Progress{}, "")
+	return changes, nil
+}
 
-		// Start mining again
+// rollbackAssignment stops the new miners, reconfigures the reconfigured
+// miners back and restarts the miners that were stopped for the assignment
+// with their previous config. The caller must hold ctl.applyMutex and
+// ctl.mutex
+func (ctl *Ctl) rollbackAssignment(
+	keptMiners map[string]miner.Miner,
+	reconfiguredMiners []miner.Miner,
+	stoppedMiners []miner.Miner,
+	newMiners []*miner.Supervisor) {
+
+	ctl.discardMiners(newMiners)
+
+	var previousConfigs []*rpcproto.MinerConfig
+	if ctl.currentAssignment != nil {
+		previousConfigs = ctl.currentAssignment.MinerConfigs
+	}
+	restoreKeys := make(map[string]bool)
+	for _, stoppedMiner := range stoppedMiners {
+		restoreKeys[stoppedMiner.GetKey()] = true
+	}
+
+	// Copy, the caller's kept miners must not change
+	restoredMiners := make(map[string]miner.Miner)
+	for key, keptMiner := range keptMiners {
+		restoredMiners[key] = keptMiner
+	}
+	for _, reconfiguredMiner := range reconfiguredMiners {
+		key := reconfiguredMiner.GetKey()
+		err := errors.New("no previous config")
+		for _, config := range previousConfigs {
+			if config.GetKey() != key {
+				continue
+			}
+			err = miner.ErrNotSupported
+			if reconfigurer, ok := reconfiguredMiner.(miner.Reconfigurer); ok {
+				err = reconfigurer.Reconfigure(*config)
+			}
+		}
+		if err == nil {
+			restoredMiners[key] = reconfiguredMiner
+			continue
+		}
 		ctl.log.WithField(
-			"id", i,
-		).Debug("Starting miner with new assignment")
-		go func(id int) {
-			err := xmrig.Start()
-			if err != nil {
-				ctl.log.WithField(
-					"id", id,
-				).Errorf("Unable to start miner: %s", err)
-
-				packet := rpcproto.Packet{
-					Method: rpcproto.Method_RigError,
-					Params: &rpcproto.Packet_RigError{
-						RigError: &rpcproto.RigErrorDetail{
-							MinerKey: config.GetKey(),
-							Reason:   fmt.Sprintf("Unable to start rig miner: %s", err),
-						},
+			"miner_key", key,
+		).Warningf("Unable to reconfigure miner back, restarting it: %s", err)
+		err = reconfiguredMiner.Stop()
+		if err != nil {
+			ctl.log.WithField(
+				"miner_key", key,
+			).Warningf("Unable to stop miner cleanly: %s", err)
+		}
+		restoreKeys[key] = true
+	}
+	keptMiners = restoredMiners
+
+	minerDir, err := getMinersDir()
+	if err != nil {
+		ctl.log.Errorf("Unable to get current executable path: %s", err)
+		return
+	}
+
+	var miners []miner.Miner
+	updaters := make(map[string]string)
+	for minerType, key := range ctl.updaters {
+		if _, kept := keptMiners[key]; kept {
+			updaters[minerType] = key
+		}
+	}
+	for _, config := range previousConfigs {
+		key := config.GetKey()
+		if keptMiner, kept := keptMiners[key]; kept {
+			miners = append(miners, keptMiner)
+			continue
+		}
+		if !restoreKeys[key] {
+			continue
+		}
+
+		hash, err := configHash(config)
+		if err != nil {
+			ctl.log.WithField(
+				"miner_key", key,
+			).Errorf("Unable to restore miner: %s", err)
+			continue
+		}
+		minerType := minerTypeForConfig(config)
+		_, hasUpdater := updaters[minerType]
+		supervisor, err := ctl.createMiner(minerDir, config, hash, !hasUpdater)
+		if err != nil {
+			ctl.log.WithField(
+				"miner_key", key,
+			).Errorf("Unable to restore miner: %s", err)
+			continue
+		}
+		if !hasUpdater {
+			updaters[minerType] = key
+		}
+		ctl.runMiner(supervisor)
+		miners = append(miners, supervisor)
+	}
+	ctl.miners = miners
+	ctl.updaters = updaters
+}
+
+// createMiner creates and configures the miner for the config, wrapped in
+// a supervisor. The miner is not started
+func (ctl *Ctl) createMiner(
+	minerDir string,
+	config *rpcproto.MinerConfig,
+	hash string,
+	withUpdate bool) (*miner.Supervisor, error) {
+
+	// The config file name includes the hash, the new config must not
+	// overwrite the config of a running miner with the same key
+	minerType := minerTypeForConfig(config)
+	configName := fmt.Sprintf("config.%s.%s.json", configFileKey(config.GetKey()), hash[:8])
+
+	// Only the miner checking for updates downloads anything
+	if withUpdate {
+		downloadDone := make(chan struct{})
+		defer close(downloadDone)
+		go ctl.trackDownload(
+			config.GetKey(),
+			filepath.Join(minerDir, minerType),
+			downloadDone)
+	}
+
+	newMiner, err := miner.New(
+		minerType,
+		withUpdate,
+		filepath.Join(minerDir, minerType),
+		filepath.Join(minerDir, configName),
+		*config,
+	)
+	if err != nil {
+		if newMiner != nil {
+			// Remove the configs that were already rendered
+			newMiner.Stop()
+		}
+		return nil, err
+	}
+	newMiner.SetErrorHandler(ctl.minerErrorHandler)
+	if tailer, ok := newMiner.(miner.LogTailer); ok {
+		tailer.SetLogHandler(ctl.minerLogHandler)
+	}
+	if sizer, ok := newMiner.(miner.LogBufferSizer); ok {
+		sizer.SetLogBufferSize(ctl.getSettings().MinerLogLines)
+	}
+
+	// The supervisor restarts the miner if it exits unexpectedly
+	supervisor := miner.NewSupervisor(newMiner)
+	supervisor.SetCrashHandler(ctl.minerCrashHandler)
+	return supervisor, nil
+}
+
+// runMiner starts the supervised miner in the background, MiningHQ is
+// notified if it stops running
+func (ctl *Ctl) runMiner(supervisor *miner.Supervisor) {
+	key := supervisor.GetKey()
+	go func() {
+		// Start only returns once the miner is stopped or failed
+		// to keep running
+		err := supervisor.Start()
+		if err != nil {
+			ctl.log.WithField(
+				"miner_key", key,
+			).Errorf("Miner stopped running: %s", err)
+
+			packet := rpcproto.Packet{
+				Method: rpcproto.Method_RigError,
+				Params: &rpcproto.Packet_RigError{
+					RigError: &rpcproto.RigErrorDetail{
+						MinerKey: key,
+						Reason:   fmt.Sprintf("Rig miner stopped running: %s", err),
 					},
-				}
-				err = ctl.sendMessage(&packet)
-				if err != nil {
-					ctl.log.Errorf(
-						"Unable to send RigAssignmentResponse to MiningHQ: %s",
-						err)
-				}
+				},
 			}
-		}(i)
+			err = ctl.sendOrQueueMessage(&packet)
+			if err != nil {
+				ctl.log.Errorf(
+					"Unable to send RigError to MiningHQ: %s",
+					err)
+			}
+		}
+	}()
+}
 
-		ctl.currentState = rpcproto.MinerState_Mining
+// discardMiners stops the miners and removes their config files
+func (ctl *Ctl) discardMiners(miners []*miner.Supervisor) {
+	for _, supervisor := range miners {
+		err := supervisor.Stop()
+		if err != nil {
+			ctl.log.WithField(
+				"miner_key", supervisor.GetKey(),
+			).Warningf("Unable to discard miner: %s", err)
+		}
 	}
-	// NOTE: No longer needed, stats are always collected
-	// // Start loop for checking stats
-	// if ctl.currentState == rpcproto.MinerState_Mining {
-	// 	go func() {
-	// 		ctl.trackAndSubmitStats()
-	// 	}()
-	// }
-	ctl.currentAssignment = assignment
-	return nil
+}
+
+// validateAssignment checks every miner config in the assignment and
+// returns the config hashes by miner key
+func validateAssignment(
+	assignment *rpcproto.RigAssignmentRequest) (map[string]string, error) {
+
+	configHashes := make(map[string]string)
+	for _, config := range assignment.MinerConfigs {
+		if config == nil {
+			return nil, errors.New("The assignment contains an empty miner config")
+		}
+		minerType := minerTypeForConfig(config)
+		if !miner.IsRegistered(minerType) {
+			return nil, fmt.Errorf(
+				"Unknown miner type '%s' for miner %s, supported types are %v",
+				minerType,
+				config.GetKey(),
+				miner.Types())
+		}
+		err := miner.Validate(minerType, *config)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Invalid config for miner %s: %s",
+				config.GetKey(),
+				err)
+		}
+		if _, exists := configHashes[config.GetKey()]; exists {
+			return nil, fmt.Errorf(
+				"Duplicate miner key %s in assignment",
+				config.GetKey())
+		}
+		configHashes[config.GetKey()], err = configHash(config)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Unable to hash config for miner %s: %s",
+				config.GetKey(),
+				err)
+		}
+	}
+	return configHashes, nil
+}
+
+// assignmentHashes returns the config hashes of the assignment by
+// miner key
+func assignmentHashes(
+	assignment *rpcproto.RigAssignmentRequest) (map[string]string, error) {
+
+	configHashes := make(map[string]string)
+	for _, config := range assignment.MinerConfigs {
+		hash, err := configHash(config)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Unable to hash config for miner %s: %s",
+				config.GetKey(),
+				err)
+		}
+		configHashes[config.GetKey()] = hash
+	}
+	return configHashes, nil
+}
+
+// configHash returns the hash of the miner config, used to detect which
+// miners changed between assignments
+func configHash(config *rpcproto.MinerConfig) (string, error) {
+	configBytes, err := proto.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(configBytes)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// configFileKey returns the miner key made safe to use in a file name
+func configFileKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') ||
+			(r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') ||
+			r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// containsString returns true if the value is in the list
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// minerTypeForConfig returns the miner type to use for the config. MiningHQ
+// only sent xmrig assignments before the type was set, so it is the default
+func minerTypeForConfig(config *rpcproto.MinerConfig) string {
+	minerType := strings.ToLower(strings.TrimSpace(config.Miner))
+	if minerType == "" {
+		return "xmrig"
+	}
+	return minerType
+}
+
+// getMinersDir returns the directory the miners and their configs are
+// installed in
+func getMinersDir() (string, error) {
+	executablePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	// Walk up the tree to determine the correct path
+	minerDir := filepath.Dir(executablePath)
+	minerDir = filepath.Dir(minerDir)
+	return filepath.Join(minerDir, "miners"), nil
 }
@@ -0,0 +1,161 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/mininghq/miner-controller/src/mhq"
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
+)
+
+// reconnectJitter is only used by the connection loop
+var reconnectJitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// runConnection connects to MiningHQ and reconnects with exponential
+// backoff whenever the connection is lost. It only returns once Stop
+// is called. The miners are not touched, they keep mining the current
+// assignment while we're disconnected
+func (ctl *Ctl) runConnection() {
+	backoff := conf.ReconnectMinBackoff
+	for {
+		if ctl.isStopping() {
+			return
+		}
+
+		ctl.log.WithFields(logrus.Fields{
+			"PingInterval": conf.PingInterval,
+			"PongWait":     conf.PongWait,
+			"WriteWait":    conf.WriteWait,
+		}).Info("Connecting to MiningHQ services")
+		// NewWebSocketClient connects to the given endpoint and authenticates
+		client, err := mhq.NewWebSocketClient(
+			ctl.websocketEndpoint,
+			ctl.miningKey,
+			ctl.rigID,
+			ctl.onMessage)
+		if err != nil {
+			ctl.log.Warningf("Unable to connect to MiningHQ services: %s", err)
+			if !ctl.waitToReconnect(&backoff) {
+				return
+			}
+			continue
+		}
+
+		ctl.clientMutex.Lock()
+		if ctl.stopping {
+			ctl.clientMutex.Unlock()
+			client.Stop()
+			return
+		}
+		ctl.client = client
+		ctl.clientMutex.Unlock()
+		ctl.log.Info("Connected to MiningHQ services")
+
+		ctl.onConnected()
+
+		connectedAt := time.Now()
+		err = client.Start()
+
+		ctl.clientMutex.Lock()
+		ctl.client = nil
+		ctl.clientMutex.Unlock()
+
+		if ctl.isStopping() {
+			return
+		}
+		ctl.log.Warningf("Disconnected from MiningHQ services: %v", err)
+
+		// Only back off further if the connection didn't last
+		if time.Since(connectedAt) > conf.ReconnectMaxBackoff {
+			backoff = conf.ReconnectMinBackoff
+		}
+		if !ctl.waitToReconnect(&backoff) {
+			return
+		}
+	}
+}
+
+// onConnected is called every time the connection to MiningHQ
+// is established
+func (ctl *Ctl) onConnected() {
+	// Send initial request for rig information
+	packet := rpcproto.Packet{
+		Method: rpcproto.Method_RigInfo,
+		Params: &rpcproto.Packet_RigInfoRequest{
+			RigInfoRequest: &rpcproto.RigInfoRequest{
+				RigID: ctl.rigID,
+			},
+		},
+	}
+	err := ctl.sendMessage(&packet)
+	if err != nil {
+		ctl.log.WithFields(logrus.Fields{
+			"rig_id": ctl.rigID,
+			"method": packet.Method,
+		}).Errorf("Unable to query rig info: %s", err)
+	}
+
+	// Send everything we queued while disconnected
+	go ctl.drainOutbox()
+}
+
+// waitToReconnect waits for the backoff with jitter and doubles it for the
+// next attempt. It returns false if Stop was called while waiting
+func (ctl *Ctl) waitToReconnect(backoff *time.Duration) bool {
+	// Spread the reconnects of all the rigs after a MiningHQ outage,
+	// the wait is between 75% and 125% of the backoff
+	jitter := time.Duration(reconnectJitter.Int63n(int64(*backoff)/2 + 1))
+	wait := *backoff*3/4 + jitter
+
+	ctl.log.Warningf("Retrying in %s...", wait.Round(time.Second))
+
+	*backoff *= 2
+	if *backoff > conf.ReconnectMaxBackoff {
+		*backoff = conf.ReconnectMaxBackoff
+	}
+
+	select {
+	case <-ctl.shutdown:
+		return false
+	case <-time.After(wait):
+		ctl.countReconnect()
+		return true
+	}
+}
+
+// getClient returns the current MiningHQ client, nil if not connected
+func (ctl *Ctl) getClient() *mhq.WebSocketClient {
+	ctl.clientMutex.Lock()
+	defer ctl.clientMutex.Unlock()
+	return ctl.client
+}
+
+// isStopping returns true once Stop was called
+func (ctl *Ctl) isStopping() bool {
+	ctl.clientMutex.Lock()
+	defer ctl.clientMutex.Unlock()
+	return ctl.stopping
+}
@@ -25,12 +25,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -55,23 +55,93 @@ type Ctl struct {
 	// websocketEndpoint is the command websocket API endpoint
 	websocketEndpoint string
 	// grpcEndpoint is the endpoint to bind for the
-	// miner manager to use
+	// miner manager to use, 'unix:<path>' for a Unix socket
 	// Must be localhost
 	grpcEndpoint string
+	// managerTokenRequired denies the Manager API calls on TCP without the
+	// manager_token
+	managerTokenRequired bool
 	// grpcServer is the local manager API server
 	grpcServer *grpc.Server
+	// metricsEndpoint is the endpoint to bind for Prometheus metrics,
+	// metrics are disabled if empty
+	metricsEndpoint string
 	// miningKey is the unique key for this user's account
 	miningKey string
+	// stateDir is where the controller state is persisted
+	stateDir string
+	// assignmentMutex serializes the assignments received from MiningHQ,
+	// always lock it before applyMutex
+	assignmentMutex sync.Mutex
+	// assignmentSequence numbers the assignments received from MiningHQ,
+	// only the latest one is applied. Accessed atomically
+	assignmentSequence uint64
+	// applyMutex serializes the changes to the active miners, it is held
+	// while miners are downloaded. Always lock it before mutex
+	applyMutex sync.Mutex
 	// miners hold the current active miners
 	miners []miner.Miner
-	// currentState of this rig
+	// apiFailures counts the consecutive failed API checks by miner key
+	apiFailures map[string]int
+	// updaters maps each miner type to the key of the miner checking
+	// for updates, only one miner of each type may update
+	updaters map[string]string
+	// currentState of this rig, only set through setState
 	currentState rpcproto.MinerState
+	// eventState mirrors currentState for the events, they are published
+	// with and without ctl.mutex held. Accessed atomically
+	eventState int32
 	// currentAssignment is the current mining assignment
 	currentAssignment *rpcproto.RigAssignmentRequest
 	// currentInfo holds the current rig information
 	currentInfo *rpcproto.RigInfoResponse
-	// client for communicating with MiningHQ
+	// progressMutex protects progress
+	progressMutex sync.Mutex
+	// progress of the last assignment applied
+	progress *rpcproto.AssignmentProgress
+	// settingsMutex protects settings and errorReports
+	settingsMutex sync.Mutex
+	// settings are the runtime settings set by MiningHQ
+	settings runtimeSettings
+	// errorReports counts the reported miner errors by miner key
+	errorReports map[string]*errorReportWindow
+	// statsIntervalChanged wakes up the stats submission when MiningHQ
+	// changes the interval
+	statsIntervalChanged chan struct{}
+	// startupLogLevel is restored when the log level setting is cleared
+	startupLogLevel logrus.Level
+	// updatesMutex protects updating
+	updatesMutex sync.Mutex
+	// updating holds the keys of the miners being updated for MiningHQ
+	updating map[string]bool
+	// warningsMutex protects warnings
+	warningsMutex sync.Mutex
+	// warnings are the latest warnings received from MiningHQ
+	warnings []*rpcproto.RigWarningDetail
+	// outbox queues the stats and errors while MiningHQ can't be reached
+	outbox *outbox
+	// metricsServer serves the Prometheus metrics, nil if disabled
+	metricsServer *http.Server
+	// metricsMutex protects the metrics counters
+	metricsMutex sync.Mutex
+	// reconnects counts the attempts to reconnect to MiningHQ
+	reconnects uint64
+	// statsSubmitFailures counts the stats that were lost
+	statsSubmitFailures uint64
+	// minerRestarts counts the restarts by miner key
+	minerRestarts map[string]uint64
+	// statsStream, logStream and eventStream feed the Manager API streams
+	statsStream *broadcaster
+	logStream   *broadcaster
+	eventStream *broadcaster
+	// clientMutex protects the client and stopping
+	clientMutex sync.Mutex
+	// client for communicating with MiningHQ, nil while not connected
 	client *mhq.WebSocketClient
+	// stopping is set once Stop was called, we no longer reconnect
+	stopping bool
+	// shutdown is closed when Stop is called
+	shutdown chan struct{}
 	// log for logs :)
 	log *logrus.Entry
 }
@@ -80,17 +150,59 @@ type Ctl struct {
 func New(
 	websocketEndpoint string,
 	grpcEndpoint string,
+	managerTokenRequired bool,
+	metricsEndpoint string,
 	miningKey string,
 	rigID string,
+	stateDir string,
 	log *logrus.Entry,
 ) (*Ctl, error) {
 
 	ctl := Ctl{
-		rigID:             rigID,
-		websocketEndpoint: websocketEndpoint,
-		grpcEndpoint:      grpcEndpoint,
-		miningKey:         miningKey,
-		log:               log,
+		rigID:                rigID,
+		websocketEndpoint:    websocketEndpoint,
+		grpcEndpoint:         grpcEndpoint,
+		managerTokenRequired: managerTokenRequired,
+		metricsEndpoint:      metricsEndpoint,
+		miningKey:            miningKey,
+		stateDir:             stateDir,
+		shutdown:             make(chan struct{}),
+		log:                  log,
+		apiFailures:          make(map[string]int),
+		errorReports:         make(map[string]*errorReportWindow),
+		minerRestarts:        make(map[string]uint64),
+		updating:             make(map[string]bool),
+		settings:             defaultSettings(),
+		statsIntervalChanged: make(chan struct{}, 1),
+		startupLogLevel:      log.Logger.Level,
+		statsStream:          newBroadcaster(),
+		logStream:            newBroadcaster(),
+		eventStream:          newBroadcaster(),
+	}
+
+	// Settings pushed by MiningHQ before the restart still apply
+	settings, err := ctl.loadSettings()
+	if err != nil {
+		ctl.log.Warningf("Unable to load saved settings: %s", err)
+	}
+	ctl.applySettings(settings)
+
+	ctl.outbox, err = newOutbox(
+		filepath.Join(stateDir, "outbox"),
+		conf.OutboxMaxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the outbox: %s", err)
+	}
+
+	// Register the miners described by spec files, they are used the
+	// same way as the built-in miners
+	minerDir, err := getMinersDir()
+	if err != nil {
+		return nil, err
+	}
+	err = miner.LoadExternalSpecs(filepath.Join(minerDir, "specs"))
+	if err != nil {
+		ctl.log.Errorf("Unable to load external miner specs: %s", err)
 	}
 
 	go func() {
@@ -103,37 +215,42 @@ func New(
 }
 
 // Run the core controller
+//
+// The gRPC manager API and the miners are independent of the connection
+// to MiningHQ. The connection is retried until Stop is called while the
+// miners keep mining the current assignment
 func (ctl *Ctl) Run() error {
 	ctl.log.Info("Started")
 
-	// Create the gRPC manager API
-	serverOptions := []grpc.ServerOption{}
+	// Start the gRPC manager API, only the Miner Manager may use it
+	listener, serverOptions, err := ctl.listenManagerAPI()
+	if err != nil {
+		ctl.log.WithFields(logrus.Fields{
+			"endpoint": ctl.grpcEndpoint,
+		}).Errorf("Unable to start listener for Manager API server: %s", err)
+
+		return err
+	}
 	ctl.grpcServer = grpc.NewServer(serverOptions...)
 	rpcproto.RegisterManagerServiceServer(ctl.grpcServer, ctl)
 
-	var err error
-	// This loop retries forever to connect. We'll only ever execute this
-	// more than once if MiningHQ is down
-	for {
-		ctl.log.WithFields(logrus.Fields{
-			"PingInterval": conf.PingInterval,
-			"PongWait":     conf.PongWait,
-			"WriteWait":    conf.WriteWait,
-		}).Info("Connecting to MiningHQ services")
-		// NewWebSocketClient connects to the given endpoint and authenticates
-		ctl.client, err = mhq.NewWebSocketClient(
-			ctl.websocketEndpoint,
-			ctl.miningKey,
-			ctl.rigID,
-			ctl.onMessage)
-		if err == nil {
-			ctl.log.Info("Connected to MiningHQ services")
-			break
+	ctl.log.WithFields(logrus.Fields{
+		"endpoint": ctl.grpcEndpoint,
+	}).Info("gRPC API server starting")
+
+	go func() {
+		err := ctl.grpcServer.Serve(listener)
+		if err != nil {
+			ctl.log.WithFields(logrus.Fields{
+				"endpoint": ctl.grpcEndpoint,
+			}).Errorf("Unable to start gRPC Manager API server: %s", err)
 		}
+	}()
 
-		ctl.log.Warningf("Unable to connect to MiningHQ services: %s", err)
-		ctl.log.Warning("Retrying in 10 seconds...")
-		time.Sleep(time.Second * 10)
+	// The metrics are optional, mining continues if they can't be served
+	if ctl.metricsEndpoint != "" {
+		ctl.metricsServer = ctl.newMetricsServer()
+		go ctl.serveMetrics(ctl.metricsServer)
 	}
 
 	// Setup signal handlers
@@ -165,64 +282,17 @@ func (ctl *Ctl) Run() error {
 	// }
 	// ctl.sendMessage(&packet)
 
-	// Send initial request for rig information
-	packet := rpcproto.Packet{
-		Method: rpcproto.Method_RigInfo,
-		Params: &rpcproto.Packet_RigInfoRequest{
-			RigInfoRequest: &rpcproto.RigInfoRequest{
-				RigID: ctl.rigID,
-			},
-		},
-	}
-	err = ctl.sendMessage(&packet)
-	if err != nil {
-		ctl.log.WithFields(logrus.Fields{
-			"rig_id": ctl.rigID,
-			"method": packet.Method,
-		}).Errorf("Unable to query rig info: %s", err)
-	}
-
-	// Start the gRPC manager API
-	listener, err := net.Listen("tcp", ctl.grpcEndpoint)
-	if err != nil {
-		ctl.log.WithFields(logrus.Fields{
-			"endpoint": ctl.grpcEndpoint,
-		}).Errorf("Unable to start listener for Manager API server: %s", err)
-
-		return err
-	}
+	// Start mining the last assignment right away, we might not be
+	// able to reach MiningHQ
+	ctl.restoreState()
 
-	ctl.log.WithFields(logrus.Fields{
-		"endpoint": ctl.grpcEndpoint,
-	}).Info("gRPC API server starting")
-
-	go func() {
-		err = ctl.grpcServer.Serve(listener)
-		if err != nil {
-			ctl.log.WithFields(logrus.Fields{
-				"endpoint": ctl.grpcEndpoint,
-			}).Errorf("Unable to start gRPC Manager API server: %s", err)
-		}
-	}()
+	// Correct any drift between the desired and actual miners
+	go ctl.reconcileMiners()
 
 	// Once our connection is processed by MiningHQ, we'll
 	// receive the RigAssignment and start mining - if the user's account
 	// is set up for that
-	err = ctl.client.Start()
-	if err != nil {
-		switch typedErr := err.(type) {
-		case *websocket.CloseError:
-			if typedErr.Code != websocket.CloseNormalClosure {
-				err = ctl.Stop()
-				if err != nil {
-					ctl.log.Debugf("Error during stopping: %s", err)
-				}
-				return ctl.Run()
-			}
-		default:
-			return err
-		}
-	}
+	ctl.runConnection()
 	return nil
 }
 
@@ -230,27 +300,14 @@ func (ctl *Ctl) Run() error {
 func (ctl *Ctl) onMessage(data []byte, err error) error {
 
 	if err != nil {
-		switch e := err.(type) {
-		case *websocket.CloseError:
-			ctl.log.Debugf("WebSocket closing: %s", err)
-			if e.Code == websocket.CloseNormalClosure {
-				return ctl.Stop()
-			}
-			// Start reconnect attempt
-			err = ctl.Stop()
-			if err != nil {
-				ctl.log.Debugf("Error during stopping: %s", err)
-			}
-			return ctl.Run()
-		default:
+		// Returning the error ends the current connection, the
+		// connection loop reconnects unless we're stopping
+		if closeErr, ok := err.(*websocket.CloseError); ok {
+			ctl.log.Debugf("WebSocket closing: %s", closeErr)
+		} else {
 			ctl.log.Errorf("WebSocket read error: %s", err)
-			// Start reconnect attempt
-			err = ctl.Stop()
-			if err != nil {
-				ctl.log.Debugf("Error during stopping: %s", err)
-			}
-			return ctl.Run()
 		}
+		return err
 	}
 
 	var packet rpcproto.Packet
@@ -265,7 +322,62 @@ func (ctl *Ctl) onMessage(data []byte, err error) error {
 	// Handle incoming warnings
 	//
 	case rpcproto.Method_RigWarning:
-		// TODO: Implement warnings from MiningHQ
+		warning := packet.GetRigWarning()
+		if warning == nil {
+			ctl.log.WithFields(logrus.Fields{
+				"method": packet.Method.String(),
+				"params": "RigWarningDetail",
+			}).Error("Params are nil")
+			return errors.New("params are nil")
+		}
+
+		ctl.log.WithFields(logrus.Fields{
+			"method": packet.Method.String(),
+			"params": "RigWarningDetail",
+		}).Debug("New RPC message processing")
+
+		ctl.handleWarning(warning)
+
+	//
+	// Handle runtime settings pushed by MiningHQ
+	//
+	case rpcproto.Method_Settings:
+		request := packet.GetSettings()
+		if request == nil {
+			ctl.log.WithFields(logrus.Fields{
+				"method": packet.Method.String(),
+				"params": "RigSettings",
+			}).Error("Params are nil")
+			return errors.New("params are nil")
+		}
+
+		ctl.log.WithFields(logrus.Fields{
+			"method": packet.Method.String(),
+			"params": "RigSettings",
+		}).Debug("New RPC message processing")
+
+		settings, err := ctl.handleSettings(request)
+		if err != nil {
+			ctl.log.Errorf("Unable to apply settings: %s", err)
+		}
+
+		// Send the active settings back
+		response := rpcproto.Packet{
+			Method: rpcproto.Method_Settings,
+			Params: &rpcproto.Packet_Settings{
+				Settings: &rpcproto.RigSettings{
+					StatsIntervalSeconds:       uint32(settings.StatsInterval / time.Second),
+					LogLevel:                   settings.LogLevel,
+					MinerLogLines:              uint32(settings.MinerLogLines),
+					ErrorReportBurst:           uint32(settings.ErrorReportBurst),
+					ErrorReportIntervalSeconds: uint32(settings.ErrorReportInterval / time.Second),
+				},
+			},
+		}
+		err = ctl.sendMessage(&response)
+		if err != nil {
+			ctl.log.Errorf("Unable to send RigSettings to MiningHQ: %s", err)
+		}
 
 	//
 	// Handle incoming state update requests
@@ -378,50 +490,10 @@ func (ctl *Ctl) onMessage(data []byte, err error) error {
 			"params": "RigAssignmentRequest",
 		}).Debug("New RPC message processing")
 
-		err = ctl.handleAssignment(request)
-		if err != nil {
-			ctl.log.Errorf("Unable to update mining assignment: %s", err)
-			// Send response message
-			response := rpcproto.Packet{
-				Method: rpcproto.Method_RigAssignment,
-				Params: &rpcproto.Packet_RigAssignmentResponse{
-					RigAssignmentResponse: &rpcproto.RigAssignmentResponse{
-						Status:     "RigAssignment error",
-						StatusCode: http.StatusInternalServerError,
-						Reason:     fmt.Sprintf("Unable to update rig assignment: %s", err),
-					},
-				},
-			}
-			err = ctl.sendMessage(&response)
-			if err != nil {
-				ctl.log.Errorf("Unable to send RigAssignmentResponse to MiningHQ: %s", err)
-			}
-			return err
-		}
-		ctl.log.Info("Rig has been reconfigured with new mining assignment")
-
-		var minerVersions []string
-		ctl.mutex.Lock()
-		for _, miner := range ctl.miners {
-			minerVersions = append(minerVersions, fmt.Sprintf("%s %s", miner.GetType(), miner.GetVersion()))
-		}
-		ctl.mutex.Unlock()
-
-		// Send response message
-		response := rpcproto.Packet{
-			Method: rpcproto.Method_RigAssignment,
-			Params: &rpcproto.Packet_RigAssignmentResponse{
-				RigAssignmentResponse: &rpcproto.RigAssignmentResponse{
-					Status:        "Ok",
-					StatusCode:    http.StatusOK,
-					MinerVersions: minerVersions,
-				},
-			},
-		}
-		err = ctl.sendMessage(&response)
-		if err != nil {
-			ctl.log.Errorf("Unable to send RigAssignmentResponse to MiningHQ: %s", err)
-		}
+		// Applying an assignment may download miners, don't block
+		// reading from MiningHQ
+		sequence := atomic.AddUint64(&ctl.assignmentSequence, 1)
+		go ctl.applyAssignment(request, sequence)
 
 	//
 	// Handle rig information received
@@ -505,7 +577,51 @@ func (ctl *Ctl) sendMessage(packet *rpcproto.Packet) error {
 	if err != nil {
 		return err
 	}
-	return ctl.client.WriteMessage(packetBytes)
+	client := ctl.getClient()
+	if client == nil {
+		return errors.New("not connected to MiningHQ")
+	}
+	return client.WriteMessage(packetBytes)
+}
+
+// sendOrQueueMessage sends the packet to MiningHQ, or queues it in the
+// outbox if it can't be sent right now. Queued packets are sent in order
+// once we're connected again
+func (ctl *Ctl) sendOrQueueMessage(packet *rpcproto.Packet) error {
+	// Packets must not overtake the ones already queued
+	if ctl.outbox.len() == 0 {
+		err := ctl.sendMessage(packet)
+		if err == nil {
+			return nil
+		}
+		ctl.log.Debugf("Unable to send message, queueing: %s", err)
+	}
+
+	err := ctl.outbox.push(packet)
+	if err != nil {
+		return fmt.Errorf("Unable to queue message: %s", err)
+	}
+	if ctl.getClient() != nil {
+		go ctl.drainOutbox()
+	}
+	return nil
+}
+
+// drainOutbox sends the queued packets to MiningHQ
+func (ctl *Ctl) drainOutbox() {
+	if ctl.outbox.len() == 0 {
+		return
+	}
+	sent, err := ctl.outbox.drain(ctl.sendMessage)
+	log := ctl.log.WithFields(logrus.Fields{
+		"sent":   sent,
+		"queued": ctl.outbox.len(),
+	})
+	if err != nil {
+		log.Warningf("Unable to send queued messages: %s", err)
+		return
+	}
+	log.Info("Sent queued messages to MiningHQ")
 }
 
 // trackAndSubmitStats gets the stats from the miners and submits it
@@ -519,86 +635,209 @@ func (ctl *Ctl) trackAndSubmitStats() {
 
 		ctl.mutex.Lock()
 		minerCount := len(ctl.miners)
+		state := ctl.currentState
 		for _, miner := range ctl.miners {
 			minerVersions = append(minerVersions, fmt.Sprintf("%s %s", miner.GetType(), miner.GetVersion()))
 		}
 		ctl.mutex.Unlock()
 		// If we have no miners and not in the mining state, then stop sending stats
-		if minerCount > 0 && ctl.currentState == rpcproto.MinerState_Mining {
+		if minerCount > 0 && state == rpcproto.MinerState_Mining {
 			statsCollection := ctl.getMinersStats()
 
 			ctl.log.WithFields(logrus.Fields{
 				"rig_id": ctl.rigID,
 			}).Debug("Sending stats")
 
+			statsResponse := rpcproto.StatsResponse{
+				Stats:         statsCollection,
+				MinerVersions: minerVersions,
+				Timestamp:     time.Now().Unix(),
+			}
+			ctl.statsStream.publish(&statsResponse)
+
 			packet = rpcproto.Packet{
 				Method: rpcproto.Method_Stats,
 				Params: &rpcproto.Packet_StatsResponse{
-					StatsResponse: &rpcproto.StatsResponse{
-						Stats:         statsCollection,
-						MinerVersions: minerVersions,
-					},
+					StatsResponse: &statsResponse,
 				},
 			}
-			err = ctl.sendMessage(&packet)
+			// The stats are queued if MiningHQ can't be reached, we don't
+			// want gaps in the hashrate history
+			err = ctl.sendOrQueueMessage(&packet)
 			if err != nil {
+				ctl.countStatsSubmitFailure()
 				ctl.log.WithField(
 					"rig_id", ctl.rigID,
 				).Warningf("Unable to send rig stats: %s", err)
-				continue
+			} else {
+				ctl.log.WithFields(logrus.Fields{
+					"rig_id": ctl.rigID,
+				}).Debug("Stats sent")
 			}
 
-			ctl.log.WithFields(logrus.Fields{
-				"rig_id": ctl.rigID,
-			}).Debug("Stats sent")
-
 		} else {
 			ctl.log.Debug("No miners connected or not mining, not checking stats")
 		}
 
-		// Sleep time for stats config
-		time.Sleep(conf.StatsSubmitInterval)
+		if !ctl.waitStatsInterval() {
+			return
+		}
 	}
 }
 
-// minerErrorHandler handles errors reported by the miner
-func (ctl *Ctl) minerErrorHandler(minerKey string, errorText string) {
-	ctl.log.WithFields(logrus.Fields{
-		"key": minerKey,
-	}).Errorf("Detected miner error: %s", errorText)
+// waitStatsInterval waits for the stats interval, MiningHQ may change it
+// while we wait. It returns false if the controller is stopping
+func (ctl *Ctl) waitStatsInterval() bool {
+	timer := time.NewTimer(ctl.getSettings().StatsInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctl.shutdown:
+			return false
+		case <-timer.C:
+			return true
+		case <-ctl.statsIntervalChanged:
+			// The new interval counts from now
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(ctl.getSettings().StatsInterval)
+		}
+	}
+}
+
+// minerErrorHandler handles errors and warnings parsed from the
+// miner output
+func (ctl *Ctl) minerErrorHandler(minerKey string, event miner.OutputEvent) {
+	log := ctl.log.WithFields(logrus.Fields{
+		"key":      minerKey,
+		"event":    event.Type.String(),
+		"severity": event.Severity.String(),
+	})
+	if event.Pool != "" {
+		log = log.WithField("pool", event.Pool)
+	}
+	if event.Difficulty > 0 {
+		log = log.WithField("difficulty", event.Difficulty)
+	}
+	if event.Latency > 0 {
+		log = log.WithField("latency", event.Latency)
+	}
+
+	reason := event.Reason
+	if reason == "" {
+		reason = event.Line
+	}
+
+	if event.Severity >= miner.SeverityError {
+		ctl.publishEvent(eventMinerError, minerKey, reason)
+	} else {
+		ctl.publishEvent(eventMinerWarning, minerKey, reason)
+	}
+
+	// A misbehaving miner must not flood MiningHQ
+	allowed, dropped := ctl.allowErrorReport(minerKey)
+	if dropped > 0 {
+		ctl.reportDroppedErrors(minerKey, dropped)
+	}
+	if !allowed {
+		if event.Severity >= miner.SeverityError {
+			log.Errorf("Detected miner error, not reported: %s", reason)
+		} else {
+			log.Warningf("Detected miner warning, not reported: %s", reason)
+		}
+		return
+	}
 
 	var packet rpcproto.Packet
-	// If the output contains 'error', generate and error, otherwise a warning
-	if strings.Contains(strings.ToLower(errorText), "error") {
+	if event.Severity >= miner.SeverityError {
+		log.Errorf("Detected miner error: %s", reason)
 		packet = rpcproto.Packet{
 			Method: rpcproto.Method_RigError,
 			Params: &rpcproto.Packet_RigError{
 				RigError: &rpcproto.RigErrorDetail{
 					MinerKey: minerKey,
-					Reason:   errorText,
+					Reason:   reason,
 				},
 			},
 		}
 	} else {
+		log.Warningf("Detected miner warning: %s", reason)
 		packet = rpcproto.Packet{
 			Method: rpcproto.Method_RigWarning,
 			Params: &rpcproto.Packet_RigWarning{
 				RigWarning: &rpcproto.RigWarningDetail{
 					MinerKey: minerKey,
-					Reason:   errorText,
+					Reason:   reason,
 				},
 			},
 		}
 	}
 
-	err := ctl.sendMessage(&packet)
+	err := ctl.sendOrQueueMessage(&packet)
 	if err != nil {
 		ctl.log.Errorf(
-			"Unable to send RigAssignmentResponse to MiningHQ: %s",
+			"Unable to send miner error to MiningHQ: %s",
 			err)
 	}
 }
 
+// reportDroppedErrors tells MiningHQ how many errors and warnings of the
+// miner were not reported due to the rate limit
+func (ctl *Ctl) reportDroppedErrors(minerKey string, dropped int) {
+	packet := rpcproto.Packet{
+		Method: rpcproto.Method_RigWarning,
+		Params: &rpcproto.Packet_RigWarning{
+			RigWarning: &rpcproto.RigWarningDetail{
+				MinerKey: minerKey,
+				Reason: fmt.Sprintf(
+					"%d miner errors and warnings were not reported due to the rate limit",
+					dropped),
+			},
+		},
+	}
+	err := ctl.sendOrQueueMessage(&packet)
+	if err != nil {
+		ctl.log.Errorf("Unable to send RigWarning to MiningHQ: %s", err)
+	}
+}
+
+// minerCrashHandler handles unexpected miner exits reported by the
+// miner supervisor. Crash loops are reported by the supervisor returning,
+// we only log and warn MiningHQ about the restarts here
+func (ctl *Ctl) minerCrashHandler(minerKey string, report miner.CrashReport) {
+	log := ctl.log.WithFields(logrus.Fields{
+		"key":       minerKey,
+		"exit_code": report.ExitCode,
+		"signal":    report.Signal,
+		"crashes":   report.Crashes,
+	})
+	ctl.publishEvent(eventMinerCrashed, minerKey, report.String())
+	if report.CrashLoop {
+		log.Errorf("Miner crash loop detected: %v", report.Err)
+		return
+	}
+	log.Warningf("Miner exited unexpectedly, restarting in %s: %v", report.RestartIn, report.Err)
+	ctl.countMinerRestart(minerKey)
+
+	packet := rpcproto.Packet{
+		Method: rpcproto.Method_RigWarning,
+		Params: &rpcproto.Packet_RigWarning{
+			RigWarning: &rpcproto.RigWarningDetail{
+				MinerKey: minerKey,
+				Reason:   report.String(),
+			},
+		},
+	}
+	err := ctl.sendOrQueueMessage(&packet)
+	if err != nil {
+		ctl.log.Errorf("Unable to send RigWarning to MiningHQ: %s", err)
+	}
+}
+
 // GetInfo returns the information about the rig
 func (ctl *Ctl) GetInfo(
 	ctx context.Context,
@@ -725,12 +964,52 @@ func (ctl *Ctl) GetLogs(
 	return &response, nil
 }
 
+// GetWarnings returns the latest warnings received from MiningHQ
+func (ctl *Ctl) GetWarnings(
+	ctx context.Context,
+	request *rpcproto.WarningsRequest) (*rpcproto.WarningsResponse, error) {
+
+	ctl.log.WithFields(logrus.Fields{
+		"method": "GetWarnings",
+	}).Debug("New gRPC message processing")
+
+	response := rpcproto.WarningsResponse{
+		Warnings: ctl.getWarnings(),
+	}
+
+	return &response, nil
+}
+
+// GetAssignmentProgress returns the progress of the last assignment
+func (ctl *Ctl) GetAssignmentProgress(
+	ctx context.Context,
+	request *rpcproto.AssignmentProgressRequest) (*rpcproto.AssignmentProgress, error) {
+
+	ctl.log.WithFields(logrus.Fields{
+		"method": "GetAssignmentProgress",
+	}).Debug("New gRPC message processing")
+
+	return ctl.getProgress(), nil
+}
+
 // Stop the core controller
 func (ctl *Ctl) Stop() error {
 	defer ctl.log.Info("Shutdown")
 
+	// Stop reconnecting to MiningHQ
+	ctl.clientMutex.Lock()
+	if !ctl.stopping {
+		ctl.stopping = true
+		close(ctl.shutdown)
+	}
+	client := ctl.client
+	ctl.clientMutex.Unlock()
+
 	// Stop the gRPC Manager API
-	ctl.grpcServer.Stop()
+	if ctl.grpcServer != nil {
+		ctl.grpcServer.Stop()
+	}
+	ctl.stopMetrics()
 
 	// We need to stop all the miners
 	ctl.mutex.Lock()
@@ -739,9 +1018,12 @@ func (ctl *Ctl) Stop() error {
 		miner.Stop()
 	}
 	ctl.miners = nil
-	ctl.currentState = rpcproto.MinerState_StopMining
+	ctl.setState(rpcproto.MinerState_StopMining)
 	ctl.clearDiscordPresence()
-	return ctl.client.Stop()
+	if client == nil {
+		return nil
+	}
+	return client.Stop()
 }
 
 // getMinersStats retrieves the stats from each active miner and returns
@@ -752,6 +1034,9 @@ func (ctl *Ctl) getMinersStats() []*rpcproto.MinerStats {
 	ctl.mutex.Lock()
 	// Collect stats for all the miners
 	for _, miner := range ctl.miners {
+		if isStopped(miner) {
+			continue
+		}
 		var stats rpcproto.MinerStats
 		stats, err := miner.GetStats()
 		if err != nil {
@@ -768,6 +1053,9 @@ func (ctl *Ctl) getMinersStats() []*rpcproto.MinerStats {
 			"rig_id":   ctl.rigID,
 			"miner":    fmt.Sprintf("%s (%s)", miner.GetType(), miner.GetKey()),
 			"hashrate": stats.Hashrate,
+			"pool":     stats.Pool,
+			"ping":     stats.PoolPing,
+			"failures": stats.PoolFailures,
 		}).Debug("Collected stats")
 	}
 	ctl.mutex.Unlock()
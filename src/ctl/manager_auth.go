@@ -0,0 +1,316 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// unixEndpointPrefix marks a Manager API endpoint as a Unix socket path
+const unixEndpointPrefix = "unix:"
+
+// managerTokenFile holds the token the Miner Manager must send when the
+// Manager API is served on TCP
+const managerTokenFile = "manager_token"
+
+// managerTokenHeader is the gRPC metadata key for the token, the value
+// is 'Bearer <token>'
+const managerTokenHeader = "authorization"
+
+// managerAuthorizer decides if a Manager API call may proceed
+type managerAuthorizer func(ctx context.Context) error
+
+// listenManagerAPI creates the listener for the Manager API and the server
+// options that authorize every call on it. An endpoint 'unix:<path>' is
+// served on a Unix socket only the owner can use, any other endpoint is
+// served on TCP and checks the per-install token. The token is only
+// required if managerTokenRequired is set, the Miner Manager doesn't send
+// it yet. Without it, the endpoint must be a loopback address
+func (ctl *Ctl) listenManagerAPI() (net.Listener, []grpc.ServerOption, error) {
+	var listener net.Listener
+	var authorize managerAuthorizer
+	var serverOptions []grpc.ServerOption
+
+	if strings.HasPrefix(ctl.grpcEndpoint, unixEndpointPrefix) {
+		socketPath := strings.TrimPrefix(ctl.grpcEndpoint, unixEndpointPrefix)
+		var err error
+		listener, err = listenUnixSocket(socketPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		authorize = authorizePeerCredentials
+		serverOptions = append(serverOptions, grpc.Creds(peerCredentials{}))
+	} else {
+		token, err := loadManagerToken(filepath.Join(ctl.stateDir, managerTokenFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		listener, err = net.Listen("tcp", ctl.grpcEndpoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		authorize = authorizeToken(token)
+		if !ctl.managerTokenRequired {
+			address, ok := listener.Addr().(*net.TCPAddr)
+			if !ok || !address.IP.IsLoopback() {
+				listener.Close()
+				return nil, nil, fmt.Errorf(
+					"Manager API endpoint '%s' is not a loopback address, "+
+						"set MANAGER_TOKEN_REQUIRED to serve it",
+					ctl.grpcEndpoint)
+			}
+			ctl.log.Warning(
+				"The Manager API token is not required, set MANAGER_TOKEN_REQUIRED " +
+					"once every Miner Manager sends it")
+			authorize = authorizeOptionalToken(authorize)
+		}
+	}
+
+	serverOptions = append(serverOptions,
+		grpc.UnaryInterceptor(func(
+			ctx context.Context,
+			request interface{},
+			info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler) (interface{}, error) {
+
+			err := ctl.authorizeCall(ctx, authorize, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, request)
+		}),
+		grpc.StreamInterceptor(func(
+			server interface{},
+			stream grpc.ServerStream,
+			info *grpc.StreamServerInfo,
+			handler grpc.StreamHandler) error {
+
+			err := ctl.authorizeCall(stream.Context(), authorize, info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(server, stream)
+		}),
+	)
+	return listener, serverOptions, nil
+}
+
+// authorizeCall returns a PermissionDenied error if the call is not allowed
+func (ctl *Ctl) authorizeCall(
+	ctx context.Context,
+	authorize managerAuthorizer,
+	method string) error {
+
+	err := authorize(ctx)
+	if err != nil {
+		ctl.log.WithField(
+			"method", method,
+		).Warningf("Denied Manager API call: %s", err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+// listenUnixSocket listens on the socket path, replacing a socket left
+// behind by a previous run. Only the owner may connect to the socket
+func listenUnixSocket(socketPath string) (net.Listener, error) {
+	info, err := os.Lstat(socketPath)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Unable to use '%s' as socket: file exists", socketPath)
+		}
+		err = os.Remove(socketPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to remove stale socket: %s", err)
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(socketPath), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create socket directory: %s", err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// The peer credentials are checked as well, permissions only keep
+	// other users from connecting at all
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Unable to set socket permissions: %s", err)
+	}
+	return listener, nil
+}
+
+// loadManagerToken reads the Manager API token, a new one is created on
+// first use. Only the owner may read the token file
+func loadManagerToken(tokenPath string) (string, error) {
+	tokenBytes, err := ioutil.ReadFile(tokenPath)
+	if err == nil {
+		token := strings.TrimSpace(string(tokenBytes))
+		if token == "" {
+			return "", fmt.Errorf("Manager API token file '%s' is empty", tokenPath)
+		}
+		err = os.Chmod(tokenPath, 0600)
+		if err != nil {
+			return "", fmt.Errorf("Unable to set token file permissions: %s", err)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("Unable to read Manager API token: %s", err)
+	}
+
+	tokenBytes = make([]byte, 32)
+	_, err = rand.Read(tokenBytes)
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate Manager API token: %s", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+	err = ioutil.WriteFile(tokenPath, []byte(token), 0600)
+	if err != nil {
+		return "", fmt.Errorf("Unable to write Manager API token: %s", err)
+	}
+	return token, nil
+}
+
+// authorizeToken allows the calls carrying the token
+func authorizeToken(token string) managerAuthorizer {
+	return func(ctx context.Context) error {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok {
+			return errors.New("no token provided")
+		}
+		for _, value := range md.Get(managerTokenHeader) {
+			provided := strings.TrimSpace(strings.TrimPrefix(value, "Bearer "))
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return errors.New("invalid or missing token")
+	}
+}
+
+// authorizeOptionalToken allows the calls without a token, a call that
+// carries a token must carry the right one
+func authorizeOptionalToken(authorize managerAuthorizer) managerAuthorizer {
+	return func(ctx context.Context) error {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok || len(md.Get(managerTokenHeader)) == 0 {
+			return nil
+		}
+		return authorize(ctx)
+	}
+}
+
+// authorizePeerCredentials allows the calls from processes running as the
+// same user as the controller, or as root
+func authorizePeerCredentials(ctx context.Context) error {
+	callPeer, ok := peer.FromContext(ctx)
+	if !ok {
+		return errors.New("unknown peer")
+	}
+	authInfo, ok := callPeer.AuthInfo.(peerAuthInfo)
+	if !ok {
+		return errors.New("no peer credentials")
+	}
+	if authInfo.err != nil {
+		return fmt.Errorf("unable to read peer credentials: %s", authInfo.err)
+	}
+	if authInfo.uid != uint32(os.Getuid()) && authInfo.uid != 0 {
+		return fmt.Errorf(
+			"user %d (pid %d) is not allowed", authInfo.uid, authInfo.pid)
+	}
+	return nil
+}
+
+// peerAuthInfo holds the credentials of the process on the other end
+// of a Unix socket
+type peerAuthInfo struct {
+	uid uint32
+	pid int32
+	// err is set when the credentials couldn't be read, the calls
+	// are denied
+	err error
+}
+
+// AuthType returns the name of the authentication
+func (authInfo peerAuthInfo) AuthType() string {
+	return "peercred"
+}
+
+// peerCredentials reads the SO_PEERCRED credentials of Unix socket
+// connections during the gRPC handshake. It doesn't encrypt anything
+type peerCredentials struct{}
+
+// ServerHandshake reads the peer credentials of the connection
+func (peerCredentials) ServerHandshake(
+	conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn, peerAuthInfo{err: errors.New("not a Unix socket")}, nil
+	}
+	uid, pid, err := readPeerCredentials(unixConn)
+	return conn, peerAuthInfo{uid: uid, pid: pid, err: err}, nil
+}
+
+// ClientHandshake is not supported, the credentials are server only
+func (peerCredentials) ClientHandshake(
+	ctx context.Context,
+	authority string,
+	conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("peer credentials are server only")
+}
+
+// Info returns the protocol info
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+// Clone returns a copy of the credentials
+func (creds peerCredentials) Clone() credentials.TransportCredentials {
+	return creds
+}
+
+// OverrideServerName is not used by the server
+func (peerCredentials) OverrideServerName(string) error {
+	return nil
+}
@@ -0,0 +1,311 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mininghq/rpcproto/rpcproto"
+)
+
+// metricsContentType is the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricsWriter renders metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	buffer bytes.Buffer
+}
+
+// family starts a new metric family, its samples must follow
+func (writer *metricsWriter) family(name string, metricType string, help string) {
+	fmt.Fprintf(&writer.buffer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(&writer.buffer, "# TYPE %s %s\n", name, metricType)
+}
+
+// sample writes a sample, labels are name and value pairs
+func (writer *metricsWriter) sample(name string, value float64, labels ...string) {
+	writer.buffer.WriteString(name)
+	if len(labels) > 0 {
+		writer.buffer.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				writer.buffer.WriteString(",")
+			}
+			fmt.Fprintf(&writer.buffer, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		writer.buffer.WriteString("}")
+	}
+	writer.buffer.WriteString(" ")
+	writer.buffer.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	writer.buffer.WriteString("\n")
+}
+
+// escapeLabelValue escapes the characters not allowed in label values
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+	).Replace(value)
+}
+
+// newMetricsServer creates the HTTP server for the metrics endpoint
+func (ctl *Ctl) newMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", ctl.handleMetrics)
+	return &http.Server{
+		Addr:    ctl.metricsEndpoint,
+		Handler: mux,
+	}
+}
+
+// serveMetrics exposes the metrics over HTTP until the server is closed
+func (ctl *Ctl) serveMetrics(server *http.Server) {
+	ctl.log.WithField(
+		"endpoint", ctl.metricsEndpoint,
+	).Info("Metrics server starting")
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		ctl.log.WithField(
+			"endpoint", ctl.metricsEndpoint,
+		).Errorf("Unable to start metrics server: %s", err)
+	}
+}
+
+// stopMetrics stops the metrics server if it is running
+func (ctl *Ctl) stopMetrics() {
+	if ctl.metricsServer != nil {
+		ctl.metricsServer.Close()
+	}
+}
+
+// handleMetrics renders the current metrics, the miner stats are the
+// sample last collected for MiningHQ, a scrape never queries the miners
+func (ctl *Ctl) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	writer := metricsWriter{}
+	ctl.writeMinerMetrics(&writer)
+	ctl.writeControllerMetrics(&writer)
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Write(writer.buffer.Bytes())
+}
+
+// writeMinerMetrics writes the stats of every miner, labelled with the
+// miner key and type
+func (ctl *Ctl) writeMinerMetrics(writer *metricsWriter) {
+	ctl.mutex.Lock()
+	state := ctl.currentState
+	minerTypes := make(map[string]string)
+	for _, activeMiner := range ctl.miners {
+		minerTypes[activeMiner.GetKey()] = activeMiner.GetType()
+	}
+	ctl.mutex.Unlock()
+
+	// The last sample stays around after the miners stopped or were
+	// replaced, only the active miners are exported while mining
+	var statsCollection []*rpcproto.MinerStats
+	latest, ok := ctl.statsStream.latest().(*rpcproto.StatsResponse)
+	if ok && state == rpcproto.MinerState_Mining {
+		writer.family("mininghq_miner_stats_timestamp_seconds", "gauge",
+			"Unix time the miner stats were collected.")
+		writer.sample("mininghq_miner_stats_timestamp_seconds", float64(latest.Timestamp))
+		for _, stats := range latest.Stats {
+			if _, active := minerTypes[stats.Key]; active {
+				statsCollection = append(statsCollection, stats)
+			}
+		}
+	}
+
+	minerMetric := func(
+		name string,
+		metricType string,
+		help string,
+		value func(*rpcproto.MinerStats) float64) {
+
+		writer.family(name, metricType, help)
+		for _, stats := range statsCollection {
+			writer.sample(name, value(stats),
+				"key", stats.Key,
+				"type", minerTypes[stats.Key])
+		}
+	}
+
+	writer.family("mininghq_miner_hashrate", "gauge",
+		"Hashrate of the miner in hashes per second by averaging window.")
+	for _, stats := range statsCollection {
+		windows := []struct {
+			window   string
+			hashrate float64
+		}{
+			{"10s", stats.Hashrate},
+			{"60s", stats.Hashrate60S},
+			{"15m", stats.Hashrate15M},
+		}
+		for _, window := range windows {
+			writer.sample("mininghq_miner_hashrate", window.hashrate,
+				"key", stats.Key,
+				"type", minerTypes[stats.Key],
+				"window", window.window)
+		}
+	}
+	minerMetric("mininghq_miner_hashrate_max", "gauge",
+		"Highest hashrate of the miner in hashes per second.",
+		func(stats *rpcproto.MinerStats) float64 { return stats.MaxHashrate })
+	minerMetric("mininghq_miner_hashes_total", "counter",
+		"Hashes computed by the miner.",
+		func(stats *rpcproto.MinerStats) float64 { return float64(stats.TotalHashes) })
+	minerMetric("mininghq_miner_shares_total", "counter",
+		"Shares submitted by the miner.",
+		func(stats *rpcproto.MinerStats) float64 { return float64(stats.TotalShares) })
+	minerMetric("mininghq_miner_shares_accepted_total", "counter",
+		"Shares accepted by the pool.",
+		func(stats *rpcproto.MinerStats) float64 { return float64(stats.AcceptedShares) })
+	minerMetric("mininghq_miner_shares_rejected_total", "counter",
+		"Shares rejected by the pool.",
+		func(stats *rpcproto.MinerStats) float64 { return float64(stats.RejectedShares) })
+	minerMetric("mininghq_miner_difficulty", "gauge",
+		"Current share difficulty of the miner.",
+		func(stats *rpcproto.MinerStats) float64 { return float64(stats.CurrentDifficulty) })
+
+	writer.family("mininghq_miner_pool_ping_seconds", "gauge",
+		"Latency to the pool the miner is connected to.")
+	for _, stats := range statsCollection {
+		writer.sample("mininghq_miner_pool_ping_seconds", float64(stats.PoolPing)/1000,
+			"key", stats.Key,
+			"type", minerTypes[stats.Key],
+			"pool", stats.Pool)
+	}
+	writer.family("mininghq_miner_pool_failures_total", "counter",
+		"Pool connection failures of the miner.")
+	for _, stats := range statsCollection {
+		writer.sample("mininghq_miner_pool_failures_total", float64(stats.PoolFailures),
+			"key", stats.Key,
+			"type", minerTypes[stats.Key],
+			"pool", stats.Pool)
+	}
+
+	writer.family("mininghq_miner_thread_hashrate", "gauge",
+		"Hashrate of a single miner thread in hashes per second.")
+	for _, stats := range statsCollection {
+		for cpu, cpuStats := range stats.CPUs {
+			if cpuStats == nil {
+				continue
+			}
+			for thread, hashrate := range cpuStats.ThreadsHashrate {
+				writer.sample("mininghq_miner_thread_hashrate", hashrate,
+					"key", stats.Key,
+					"type", minerTypes[stats.Key],
+					"cpu", strconv.Itoa(cpu),
+					"thread", strconv.Itoa(thread))
+			}
+		}
+	}
+}
+
+// writeControllerMetrics writes the state of the controller
+func (ctl *Ctl) writeControllerMetrics(writer *metricsWriter) {
+	connected := 0.0
+	if ctl.getClient() != nil {
+		connected = 1
+	}
+	writer.family("mininghq_controller_connected", "gauge",
+		"Whether the websocket connection to MiningHQ is established.")
+	writer.sample("mininghq_controller_connected", connected)
+
+	ctl.mutex.Lock()
+	currentState := ctl.currentState
+	minerCount := len(ctl.miners)
+	ctl.mutex.Unlock()
+
+	// Every state is exported, only the current one is 1
+	states := make([]string, 0, len(rpcproto.MinerState_name))
+	for _, state := range rpcproto.MinerState_name {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	writer.family("mininghq_controller_state", "gauge",
+		"Current state of the rig, the current state is 1.")
+	for _, state := range states {
+		value := 0.0
+		if state == currentState.String() {
+			value = 1
+		}
+		writer.sample("mininghq_controller_state", value, "state", state)
+	}
+
+	writer.family("mininghq_controller_miners", "gauge",
+		"Number of active miners.")
+	writer.sample("mininghq_controller_miners", float64(minerCount))
+
+	ctl.metricsMutex.Lock()
+	reconnects := ctl.reconnects
+	statsSubmitFailures := ctl.statsSubmitFailures
+	minerRestarts := make(map[string]uint64)
+	for key, restarts := range ctl.minerRestarts {
+		minerRestarts[key] = restarts
+	}
+	ctl.metricsMutex.Unlock()
+
+	writer.family("mininghq_controller_reconnects_total", "counter",
+		"Attempts to reconnect to MiningHQ.")
+	writer.sample("mininghq_controller_reconnects_total", float64(reconnects))
+	writer.family("mininghq_controller_stats_submit_failures_total", "counter",
+		"Stats that could neither be sent to MiningHQ nor queued.")
+	writer.sample("mininghq_controller_stats_submit_failures_total", float64(statsSubmitFailures))
+
+	keys := make([]string, 0, len(minerRestarts))
+	for key := range minerRestarts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writer.family("mininghq_controller_miner_restarts_total", "counter",
+		"Restarts of a miner after crashes, failed health checks or through the Manager API.")
+	for _, key := range keys {
+		writer.sample("mininghq_controller_miner_restarts_total", float64(minerRestarts[key]), "key", key)
+	}
+}
+
+// countReconnect counts an attempt to reconnect to MiningHQ
+func (ctl *Ctl) countReconnect() {
+	ctl.metricsMutex.Lock()
+	ctl.reconnects++
+	ctl.metricsMutex.Unlock()
+}
+
+// countStatsSubmitFailure counts stats that were lost
+func (ctl *Ctl) countStatsSubmitFailure() {
+	ctl.metricsMutex.Lock()
+	ctl.statsSubmitFailures++
+	ctl.metricsMutex.Unlock()
+}
+
+// countMinerRestart counts a restart of the miner
+func (ctl *Ctl) countMinerRestart(minerKey string) {
+	ctl.metricsMutex.Lock()
+	ctl.minerRestarts[minerKey]++
+	ctl.metricsMutex.Unlock()
+}
@@ -0,0 +1,283 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+
+	"github.com/mininghq/miner-controller/src/miner"
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The lifecycle states of a miner reported by ListMiners
+const (
+	// minerStateStarting is set before the miner was started
+	minerStateStarting = "starting"
+	// minerStateRunning is set while the miner process is running
+	minerStateRunning = "running"
+	// minerStateRestarting is set while the supervisor waits to restart
+	// the miner after it exited
+	minerStateRestarting = "restarting"
+	// minerStatePaused is set while mining is paused
+	minerStatePaused = "paused"
+	// minerStateStopped is set once the miner was stopped through the
+	// Manager API
+	minerStateStopped = "stopped"
+	// minerStateFailed is set once the supervisor gave up after a crash
+	// loop, the reconciler tries again later
+	minerStateFailed = "failed"
+)
+
+// redactedValue replaces secrets in the configs returned by ListMiners
+const redactedValue = "********"
+
+// ListMiners returns the details of every active miner
+func (ctl *Ctl) ListMiners(
+	ctx context.Context,
+	request *rpcproto.ListMinersRequest) (*rpcproto.ListMinersResponse, error) {
+
+	ctl.log.WithFields(logrus.Fields{
+		"method": "ListMiners",
+	}).Debug("New gRPC message processing")
+
+	var response rpcproto.ListMinersResponse
+	ctl.mutex.Lock()
+	defer ctl.mutex.Unlock()
+	for _, activeMiner := range ctl.miners {
+		response.Miners = append(
+			response.Miners,
+			ctl.minerInfo(activeMiner))
+	}
+	return &response, nil
+}
+
+// StopMiner stops a single miner, it stays stopped until it is started
+// through the Manager API, the rig is stopped or MiningHQ changes its config
+func (ctl *Ctl) StopMiner(
+	ctx context.Context,
+	request *rpcproto.MinerControlRequest) (*rpcproto.MinerInfo, error) {
+
+	log := ctl.log.WithFields(logrus.Fields{
+		"method":    "StopMiner",
+		"miner_key": request.Key,
+	})
+	log.Debug("New gRPC message processing")
+
+	ctl.applyMutex.Lock()
+	defer ctl.applyMutex.Unlock()
+	ctl.mutex.Lock()
+	defer ctl.mutex.Unlock()
+
+	activeMiner := ctl.findMiner(request.Key)
+	if activeMiner == nil {
+		return nil, status.Errorf(codes.NotFound, "No active miner with key '%s'", request.Key)
+	}
+	if isStopped(activeMiner) {
+		return ctl.minerInfo(activeMiner), nil
+	}
+	err := activeMiner.Stop()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Unable to stop miner: %s", err)
+	}
+	log.Info("Miner stopped through the Manager API")
+	ctl.publishEvent(eventMinerStopped, request.Key, "")
+	return ctl.minerInfo(activeMiner), nil
+}
+
+// StartMiner starts a single miner that was stopped or gave up after a
+// crash loop. A running miner is left alone
+func (ctl *Ctl) StartMiner(
+	ctx context.Context,
+	request *rpcproto.MinerControlRequest) (*rpcproto.MinerInfo, error) {
+
+	return ctl.startMiner("StartMiner", request.Key, false)
+}
+
+// RestartMiner replaces a single miner with a new instance
+func (ctl *Ctl) RestartMiner(
+	ctx context.Context,
+	request *rpcproto.MinerControlRequest) (*rpcproto.MinerInfo, error) {
+
+	return ctl.startMiner("RestartMiner", request.Key, true)
+}
+
+// startMiner recreates the miner with the key from its config in the
+// current assignment. Unless restart is set, it is only recreated if it
+// is not kept running by its supervisor
+func (ctl *Ctl) startMiner(
+	method string,
+	key string,
+	restart bool) (*rpcproto.MinerInfo, error) {
+
+	log := ctl.log.WithFields(logrus.Fields{
+		"method":    method,
+		"miner_key": key,
+	})
+	log.Debug("New gRPC message processing")
+
+	ctl.applyMutex.Lock()
+	defer ctl.applyMutex.Unlock()
+
+	ctl.mutex.Lock()
+	state := ctl.currentState
+	activeMiner := ctl.findMiner(key)
+	ctl.mutex.Unlock()
+	if activeMiner == nil {
+		return nil, status.Errorf(codes.NotFound, "No active miner with key '%s'", key)
+	}
+	// The reconciler would stop or pause it again
+	if state != rpcproto.MinerState_Mining {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"The rig is not mining, it is in state %s",
+			state.String())
+	}
+
+	if !restart {
+		checker, ok := activeMiner.(miner.HealthChecker)
+		if ok {
+			health := checker.Health()
+			if !health.Stopped && !health.Paused && health.Supervised {
+				ctl.mutex.Lock()
+				defer ctl.mutex.Unlock()
+				return ctl.minerInfo(activeMiner), nil
+			}
+		}
+	}
+
+	delete(ctl.apiFailures, key)
+	err := ctl.recreateMiner(activeMiner)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Unable to start miner: %s", err)
+	}
+
+	if restart {
+		log.Info("Miner restarted through the Manager API")
+		ctl.publishEvent(eventMinerRestarted, key, "")
+	} else {
+		log.Info("Miner started through the Manager API")
+		ctl.publishEvent(eventMinerStarted, key, "")
+	}
+
+	ctl.mutex.Lock()
+	defer ctl.mutex.Unlock()
+	activeMiner = ctl.findMiner(key)
+	if activeMiner == nil {
+		return nil, status.Errorf(codes.NotFound, "No active miner with key '%s'", key)
+	}
+	return ctl.minerInfo(activeMiner), nil
+}
+
+// findMiner returns the active miner with the key, nil if there is none.
+// The caller must hold ctl.mutex
+func (ctl *Ctl) findMiner(key string) miner.Miner {
+	for _, activeMiner := range ctl.miners {
+		if activeMiner.GetKey() == key {
+			return activeMiner
+		}
+	}
+	return nil
+}
+
+// minerInfo describes the active miner for the Manager API. The caller
+// must hold ctl.mutex
+func (ctl *Ctl) minerInfo(activeMiner miner.Miner) *rpcproto.MinerInfo {
+	info := rpcproto.MinerInfo{
+		Key:     activeMiner.GetKey(),
+		Type:    activeMiner.GetType(),
+		Version: activeMiner.GetVersion(),
+		State:   minerStateRunning,
+	}
+	if checker, ok := activeMiner.(miner.HealthChecker); ok {
+		health := checker.Health()
+		info.PID = int32(health.PID)
+		info.UptimeSeconds = int64(health.Uptime.Seconds())
+		info.APIPort = int32(health.APIPort)
+		info.State = lifecycleState(health)
+	}
+	if ctl.currentAssignment != nil {
+		for _, config := range ctl.currentAssignment.MinerConfigs {
+			if config.GetKey() == info.Key {
+				info.Config = redactConfig(config)
+			}
+		}
+	}
+	return &info
+}
+
+// lifecycleState returns the lifecycle state of a miner from its health
+func lifecycleState(health miner.Health) string {
+	switch {
+	case health.Stopped:
+		return minerStateStopped
+	case !health.Supervised && !health.GaveUpAt.IsZero():
+		return minerStateFailed
+	case health.Paused:
+		return minerStatePaused
+	case health.Running:
+		return minerStateRunning
+	case health.Supervised:
+		return minerStateRestarting
+	}
+	return minerStateStarting
+}
+
+// isStopped returns true if the miner was stopped, a stopped miner is
+// only kept in ctl.miners after it was stopped through the Manager API
+func isStopped(activeMiner miner.Miner) bool {
+	checker, ok := activeMiner.(miner.HealthChecker)
+	return ok && checker.Health().Stopped
+}
+
+// isPaused returns true if the miner is paused
+func isPaused(activeMiner miner.Miner) bool {
+	checker, ok := activeMiner.(miner.HealthChecker)
+	return ok && checker.Health().Paused
+}
+
+// redactConfig returns a copy of the config without the pool passwords
+func redactConfig(config *rpcproto.MinerConfig) *rpcproto.MinerConfig {
+	redacted := *config
+	redacted.PoolConfig = redactPoolConfig(config.PoolConfig)
+	redacted.PoolConfigs = nil
+	for _, poolConfig := range config.PoolConfigs {
+		redacted.PoolConfigs = append(
+			redacted.PoolConfigs,
+			redactPoolConfig(poolConfig))
+	}
+	return &redacted
+}
+
+// redactPoolConfig returns a copy of the pool config without the password
+func redactPoolConfig(poolConfig *rpcproto.PoolConfig) *rpcproto.PoolConfig {
+	if poolConfig == nil {
+		return nil
+	}
+	redacted := *poolConfig
+	if redacted.Password != "" {
+		redacted.Password = redactedValue
+	}
+	return &redacted
+}
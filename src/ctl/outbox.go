@@ -0,0 +1,209 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mininghq/rpcproto/rpcproto"
+)
+
+// outbox is an on-disk queue of packets that could not be sent to MiningHQ.
+// Each packet is stored in its own file named by its sequence number, the
+// oldest packets are dropped when the queue exceeds maxBytes
+type outbox struct {
+	// mutex protects the fields below
+	mutex sync.Mutex
+	// dir holds the queued packets
+	dir string
+	// maxBytes is the maximum total size of the queued packets
+	maxBytes int64
+	// entries are the queued packets, oldest first
+	entries []outboxEntry
+	// size is the total size of the queued packets
+	size int64
+	// sequence is the last sequence number used
+	sequence int64
+
+	// drainMutex makes sure only one drain runs at a time
+	drainMutex sync.Mutex
+}
+
+// outboxEntry is a single queued packet
+type outboxEntry struct {
+	sequence int64
+	size     int64
+}
+
+// newOutbox opens the outbox in the directory and loads the packets
+// queued before a restart
+func newOutbox(dir string, maxBytes int64) (*outbox, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	box := outbox{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".pb" {
+			continue
+		}
+		sequence, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), ".pb"), 10, 64)
+		if err != nil {
+			continue
+		}
+		box.entries = append(box.entries, outboxEntry{
+			sequence: sequence,
+			size:     file.Size(),
+		})
+		box.size += file.Size()
+		if sequence > box.sequence {
+			box.sequence = sequence
+		}
+	}
+	sort.Slice(box.entries, func(i, j int) bool {
+		return box.entries[i].sequence < box.entries[j].sequence
+	})
+	return &box, nil
+}
+
+// push adds the packet to the end of the queue
+func (box *outbox) push(packet *rpcproto.Packet) error {
+	packetBytes, err := proto.Marshal(packet)
+	if err != nil {
+		return err
+	}
+
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+
+	// Sequence numbers are timestamps, but must always increase
+	sequence := time.Now().UnixNano()
+	if sequence <= box.sequence {
+		sequence = box.sequence + 1
+	}
+	err = ioutil.WriteFile(box.path(sequence), packetBytes, 0600)
+	if err != nil {
+		return err
+	}
+	box.sequence = sequence
+	box.entries = append(box.entries, outboxEntry{
+		sequence: sequence,
+		size:     int64(len(packetBytes)),
+	})
+	box.size += int64(len(packetBytes))
+
+	// Drop the oldest packets to stay within the size limit
+	for box.size > box.maxBytes && len(box.entries) > 1 {
+		box.removeOldestLocked()
+	}
+	return nil
+}
+
+// drain sends the queued packets in order until the queue is empty or
+// sending fails. It returns the number of packets sent
+func (box *outbox) drain(send func(*rpcproto.Packet) error) (int, error) {
+	box.drainMutex.Lock()
+	defer box.drainMutex.Unlock()
+
+	sent := 0
+	for {
+		box.mutex.Lock()
+		if len(box.entries) == 0 {
+			box.mutex.Unlock()
+			return sent, nil
+		}
+		entry := box.entries[0]
+		box.mutex.Unlock()
+
+		packetBytes, err := ioutil.ReadFile(box.path(entry.sequence))
+		if err != nil {
+			// Either dropped while we were sending or unreadable, skip it
+			box.remove(entry.sequence)
+			continue
+		}
+		var packet rpcproto.Packet
+		err = proto.Unmarshal(packetBytes, &packet)
+		if err != nil {
+			box.remove(entry.sequence)
+			continue
+		}
+
+		err = send(&packet)
+		if err != nil {
+			return sent, err
+		}
+		box.remove(entry.sequence)
+		sent++
+	}
+}
+
+// len returns the number of queued packets
+func (box *outbox) len() int {
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+	return len(box.entries)
+}
+
+// remove deletes the packet from the queue
+func (box *outbox) remove(sequence int64) {
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+	for i, entry := range box.entries {
+		if entry.sequence == sequence {
+			os.Remove(box.path(sequence))
+			box.size -= entry.size
+			box.entries = append(box.entries[:i], box.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeOldestLocked deletes the oldest packet, the mutex must be held
+func (box *outbox) removeOldestLocked() {
+	oldest := box.entries[0]
+	os.Remove(box.path(oldest.sequence))
+	box.size -= oldest.size
+	box.entries = box.entries[1:]
+}
+
+// path returns the file path for the packet
+func (box *outbox) path(sequence int64) string {
+	return filepath.Join(box.dir, fmt.Sprintf("%020d.pb", sequence))
+}
@@ -0,0 +1,191 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
+)
+
+// savedState is the controller state we persist to resume mining after a
+// restart, even if MiningHQ can't be reached
+type savedState struct {
+	// State is the rig state at the time of saving
+	State rpcproto.MinerState
+	// Assignment is the last accepted assignment, serialized as protobuf
+	Assignment []byte
+	// SavedAt is when the state was saved
+	SavedAt time.Time
+}
+
+// statePath returns the path of the persisted state file
+func (ctl *Ctl) statePath() string {
+	return filepath.Join(ctl.stateDir, "state.json")
+}
+
+// saveState persists the current assignment and state
+// The caller must hold ctl.mutex
+func (ctl *Ctl) saveState() error {
+	state := savedState{
+		State:   ctl.currentState,
+		SavedAt: time.Now(),
+	}
+	if ctl.currentAssignment != nil {
+		assignmentBytes, err := proto.Marshal(ctl.currentAssignment)
+		if err != nil {
+			return err
+		}
+		state.Assignment = assignmentBytes
+	}
+
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ctl.statePath(), stateBytes)
+}
+
+// writeFileAtomic replaces the file with the data, readable only by the
+// owner. The data is written to a temporary file and synced before it
+// is renamed, a crash leaves either the old or the new file
+func writeFileAtomic(path string, data []byte) error {
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	// Persist the rename as well, directories can't be synced on
+	// every platform
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	dir.Sync()
+	dir.Close()
+	return nil
+}
+
+// loadState reads the persisted state. It returns nil if nothing was saved
+func (ctl *Ctl) loadState() (*savedState, *rpcproto.RigAssignmentRequest, error) {
+	stateBytes, err := ioutil.ReadFile(ctl.statePath())
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var state savedState
+	err = json.Unmarshal(stateBytes, &state)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(state.Assignment) == 0 {
+		return &state, nil, nil
+	}
+
+	var assignment rpcproto.RigAssignmentRequest
+	err = proto.Unmarshal(state.Assignment, &assignment)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &state, &assignment, nil
+}
+
+// restoreState restores the persisted assignment and state and starts
+// mining if we were mining before. The miners are started in the
+// background, connecting to MiningHQ must not wait for downloads. An
+// assignment received from MiningHQ always replaces the restored one
+func (ctl *Ctl) restoreState() {
+	state, assignment, err := ctl.loadState()
+	if err != nil {
+		ctl.log.Warningf("Unable to restore saved state: %s", err)
+		return
+	}
+	if state == nil || assignment == nil {
+		ctl.log.Debug("No saved assignment to restore")
+		return
+	}
+
+	log := ctl.log.WithFields(logrus.Fields{
+		"state":    state.State.String(),
+		"saved_at": state.SavedAt,
+		"miners":   len(assignment.MinerConfigs),
+	})
+
+	switch state.State {
+	case rpcproto.MinerState_Mining,
+		rpcproto.MinerState_StartMining,
+		rpcproto.MinerState_ResumeMining:
+		log.Info("Resuming saved assignment")
+		sequence := atomic.AddUint64(&ctl.assignmentSequence, 1)
+		go func() {
+			_, err := ctl.applyLatestAssignment(assignment, sequence)
+			if err == errAssignmentSuperseded {
+				log.Info("Saved assignment was replaced by MiningHQ")
+				return
+			}
+			if err != nil {
+				log.Errorf("Unable to resume saved assignment: %s", err)
+			}
+		}()
+	default:
+		// The rig was stopped, keep the assignment for when it is started
+		ctl.assignmentMutex.Lock()
+		defer ctl.assignmentMutex.Unlock()
+		ctl.mutex.Lock()
+		defer ctl.mutex.Unlock()
+		if ctl.currentAssignment != nil {
+			log.Info("Saved assignment was replaced by MiningHQ")
+			return
+		}
+		log.Info("Restored saved assignment, not mining")
+		ctl.currentAssignment = assignment
+		ctl.setState(state.State)
+	}
+}
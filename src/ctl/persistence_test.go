@@ -0,0 +1,64 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mininghq-state")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	for _, contents := range []string{`{"State":1}`, `{"State":2}`} {
+		err = writeFileAtomic(path, []byte(contents))
+		if err != nil {
+			t.Fatalf("writeFileAtomic returned error: %s", err)
+		}
+		written, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Unable to read written file: %s", err)
+		}
+		if string(written) != contents {
+			t.Errorf("File contains %q, expected %q", written, contents)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unable to stat written file: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("File mode is %v, expected 0600", info.Mode().Perm())
+	}
+	_, err = os.Stat(path + ".tmp")
+	if !os.IsNotExist(err) {
+		t.Error("The temporary file was left behind")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/mininghq/miner-controller/src/mhq"
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
+)
+
+// The phases reported while an assignment is applied
+const (
+	// phaseValidating checks the miner configs in the assignment
+	phaseValidating = "validating"
+	// phaseDownloading downloads or updates a miner
+	phaseDownloading = "downloading"
+	// phaseConfiguring renders the config for a miner
+	phaseConfiguring = "configuring"
+	// phaseStarting swaps the miners and waits for them to keep running
+	phaseStarting = "starting"
+	// phaseApplied is reported once the assignment is running
+	phaseApplied = "applied"
+	// phaseFailed is reported when the assignment could not be applied
+	phaseFailed = "failed"
+)
+
+// downloadSizeUnknown is reported as BytesTotal while downloading,
+// Unattended doesn't tell us the size of the download
+const downloadSizeUnknown = -1
+
+// reportProgress records the assignment progress for the Miner Manager
+// and sends it to MiningHQ. Progress is not queued while disconnected,
+// only the latest progress is of interest
+func (ctl *Ctl) reportProgress(
+	phase string,
+	minerKey string,
+	progress mhq.Progress,
+	reason string) {
+
+	assignmentProgress := rpcproto.AssignmentProgress{
+		Phase:          phase,
+		MinerKey:       minerKey,
+		BytesCompleted: progress.BytesCompleted,
+		BytesTotal:     progress.BytesTotal,
+		Reason:         reason,
+		Timestamp:      time.Now().Unix(),
+	}
+	ctl.progressMutex.Lock()
+	ctl.progress = &assignmentProgress
+	ctl.progressMutex.Unlock()
+	ctl.publishEvent(
+		progressEventType(phase),
+		minerKey,
+		progressEventMessage(&assignmentProgress))
+
+	ctl.log.WithFields(logrus.Fields{
+		"phase":           phase,
+		"miner_key":       minerKey,
+		"bytes_completed": progress.BytesCompleted,
+		"bytes_total":     progress.BytesTotal,
+	}).Debug("Assignment progress")
+
+	packet := rpcproto.Packet{
+		Method: rpcproto.Method_AssignmentProgress,
+		Params: &rpcproto.Packet_AssignmentProgress{
+			AssignmentProgress: &assignmentProgress,
+		},
+	}
+	err := ctl.sendMessage(&packet)
+	if err != nil {
+		ctl.log.Debugf("Unable to send assignment progress: %s", err)
+	}
+}
+
+// getProgress returns the progress of the last assignment
+func (ctl *Ctl) getProgress() *rpcproto.AssignmentProgress {
+	ctl.progressMutex.Lock()
+	defer ctl.progressMutex.Unlock()
+	if ctl.progress == nil {
+		return &rpcproto.AssignmentProgress{}
+	}
+	progress := *ctl.progress
+	return &progress
+}
+
+// trackDownload reports the growth of the miner directory as download
+// progress until done is closed. The total is reported as
+// downloadSizeUnknown
+func (ctl *Ctl) trackDownload(minerKey string, path string, done chan struct{}) {
+
+	initialSize := dirSize(path)
+	ticker := time.NewTicker(conf.DownloadProgressInterval)
+	defer ticker.Stop()
+
+	var lastCompleted int64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			completed := dirSize(path) - initialSize
+			if completed <= lastCompleted {
+				// Nothing is being downloaded
+				continue
+			}
+			lastCompleted = completed
+			ctl.reportProgress(
+				phaseDownloading,
+				minerKey,
+				mhq.Progress{
+					BytesCompleted: completed,
+					BytesTotal:     downloadSizeUnknown,
+				},
+				"")
+		}
+	}
+}
+
+// dirSize returns the total size of the files in the directory
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,292 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/mininghq/miner-controller/src/miner"
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
+)
+
+// reconcileMiners periodically compares the desired state, the assignment
+// and currentState, with the actual miners and corrects any drift
+func (ctl *Ctl) reconcileMiners() {
+	ticker := time.NewTicker(conf.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctl.shutdown:
+			return
+		case <-ticker.C:
+			ctl.reconcile()
+		}
+	}
+}
+
+// reconcile corrects the differences between the desired and actual
+// state once
+func (ctl *Ctl) reconcile() {
+	ctl.mutex.Lock()
+	state := ctl.currentState
+	assignment := ctl.currentAssignment
+	runningKeys := make(map[string]bool)
+	unpaused := 0
+	for _, activeMiner := range ctl.miners {
+		runningKeys[activeMiner.GetKey()] = true
+		checker, ok := activeMiner.(miner.HealthChecker)
+		if !ok || !checker.Health().Paused {
+			unpaused++
+		}
+	}
+	ctl.mutex.Unlock()
+
+	if ctl.isStopping() {
+		return
+	}
+
+	switch state {
+	case rpcproto.MinerState_StopMining, rpcproto.MinerState_PauseMining:
+		// Nothing may be mining, paused miners keep running
+		if unpaused == 0 {
+			return
+		}
+		ctl.reportCorrection("", fmt.Sprintf(
+			"Rig is in state %s but %d miners are mining, stopping them",
+			state.String(),
+			unpaused))
+		err := ctl.handleControl(&rpcproto.StateRequest{State: state})
+		if err != nil {
+			ctl.log.Errorf("Unable to stop the miners: %s", err)
+		}
+		return
+
+	case rpcproto.MinerState_Mining,
+		rpcproto.MinerState_StartMining,
+		rpcproto.MinerState_ResumeMining:
+		if assignment == nil {
+			return
+		}
+		// Every miner in the assignment must be running, applying the
+		// assignment again only starts the missing miners
+		var missingKeys []string
+		for _, config := range assignment.MinerConfigs {
+			if !runningKeys[config.GetKey()] {
+				missingKeys = append(missingKeys, config.GetKey())
+			}
+		}
+		if len(missingKeys) > 0 {
+			ctl.reportCorrection("", fmt.Sprintf(
+				"Rig is mining but miners %v are not running, starting them",
+				missingKeys))
+			_, err := ctl.reapplyAssignment(assignment)
+			if err == errAssignmentReplaced {
+				ctl.log.Debug("Assignment changed, the missing miners were not started")
+				return
+			}
+			if err != nil {
+				ctl.log.Errorf("Unable to start the missing miners: %s", err)
+			}
+			return
+		}
+		ctl.reconcileHealth()
+	}
+}
+
+// reconcileHealth resumes paused miners and recreates the miners that are
+// no longer supervised, lost their config files or whose API stopped
+// responding. The API failures are only accessed while holding
+// ctl.applyMutex
+func (ctl *Ctl) reconcileHealth() {
+	// The miners must not change while we replace them
+	ctl.applyMutex.Lock()
+	defer ctl.applyMutex.Unlock()
+
+	ctl.mutex.Lock()
+	activeMiners := append([]miner.Miner(nil), ctl.miners...)
+	ctl.mutex.Unlock()
+
+	activeKeys := make(map[string]bool)
+	for _, activeMiner := range activeMiners {
+		key := activeMiner.GetKey()
+		activeKeys[key] = true
+
+		checker, ok := activeMiner.(miner.HealthChecker)
+		if !ok {
+			continue
+		}
+		health := checker.Health()
+
+		reason := ""
+		switch {
+		case health.Stopped:
+			// Stopped through the Manager API, it stays stopped
+			continue
+		case !health.Supervised:
+			// The supervisor gave up after a crash loop, give the miner
+			// another chance once the crash loop window passed. A miner
+			// that was not started yet never gave up
+			if health.GaveUpAt.IsZero() ||
+				time.Since(health.GaveUpAt) < conf.MinerCrashLoopWindow {
+				continue
+			}
+			reason = "Miner is no longer running, restarting it"
+		case health.Paused:
+			// Paused miners are only kept while the rig is paused
+			err := resumeMiner(activeMiner)
+			if err == nil {
+				ctl.reportCorrection(key, "Miner was paused while the rig is mining, resumed it")
+				continue
+			}
+			reason = fmt.Sprintf(
+				"Miner is paused while the rig is mining and can't be resumed, restarting it: %s",
+				err)
+		case health.ConfigMissing:
+			reason = "Miner config file was removed, recreating the miner"
+		case health.Running && health.Uptime > conf.MinerStartupGracePeriod:
+			_, err := activeMiner.GetStats()
+			if err == nil {
+				ctl.apiFailures[key] = 0
+				continue
+			}
+			ctl.apiFailures[key]++
+			if ctl.apiFailures[key] < conf.ReconcileMaxAPIFailures {
+				continue
+			}
+			reason = fmt.Sprintf(
+				"Miner API did not respond %d times, restarting the miner: %s",
+				ctl.apiFailures[key],
+				err)
+		}
+		if reason == "" {
+			continue
+		}
+
+		ctl.reportCorrection(key, reason)
+		delete(ctl.apiFailures, key)
+		err := ctl.recreateMiner(activeMiner)
+		if err != nil {
+			ctl.log.WithField(
+				"miner_key", key,
+			).Errorf("Unable to recreate miner: %s", err)
+		}
+	}
+
+	// Forget the failures of miners that are gone
+	for key := range ctl.apiFailures {
+		if !activeKeys[key] {
+			delete(ctl.apiFailures, key)
+		}
+	}
+}
+
+// recreateMiner replaces the miner with a new instance for its config in
+// the current assignment and starts it. The caller must hold ctl.applyMutex
+func (ctl *Ctl) recreateMiner(activeMiner miner.Miner) error {
+	key := activeMiner.GetKey()
+
+	ctl.mutex.Lock()
+	var config *rpcproto.MinerConfig
+	if ctl.currentAssignment != nil {
+		for _, assignedConfig := range ctl.currentAssignment.MinerConfigs {
+			if assignedConfig.GetKey() == key {
+				config = assignedConfig
+			}
+		}
+	}
+	withUpdate := false
+	if config != nil {
+		withUpdate = ctl.updaters[minerTypeForConfig(config)] == key
+	}
+	ctl.mutex.Unlock()
+	if config == nil {
+		return fmt.Errorf("no config for miner %s in the assignment", key)
+	}
+
+	hash, err := configHash(config)
+	if err != nil {
+		return err
+	}
+	minerDir, err := getMinersDir()
+	if err != nil {
+		return err
+	}
+
+	// Stop the old miner first, the new one uses the same config path.
+	// A stopped miner already removed its config files
+	if !isStopped(activeMiner) {
+		err = activeMiner.Stop()
+		if err != nil {
+			ctl.log.WithField(
+				"miner_key", key,
+			).Warningf("Unable to stop miner cleanly: %s", err)
+		}
+	}
+	supervisor, err := ctl.createMiner(minerDir, config, hash, withUpdate)
+
+	ctl.mutex.Lock()
+	defer ctl.mutex.Unlock()
+	for i := range ctl.miners {
+		if ctl.miners[i] != activeMiner {
+			continue
+		}
+		if err != nil {
+			// The next reconcile starts it through the assignment
+			ctl.miners = append(ctl.miners[:i], ctl.miners[i+1:]...)
+			return err
+		}
+		ctl.miners[i] = supervisor
+		ctl.runMiner(supervisor)
+		ctl.countMinerRestart(key)
+		return nil
+	}
+	if supervisor != nil {
+		supervisor.Stop()
+	}
+	return err
+}
+
+// reportCorrection logs the correction made by the reconciler and reports
+// it to MiningHQ as a warning
+func (ctl *Ctl) reportCorrection(minerKey string, reason string) {
+	ctl.log.WithFields(logrus.Fields{
+		"miner_key": minerKey,
+	}).Warningf("Reconciler: %s", reason)
+	ctl.publishEvent(eventCorrection, minerKey, reason)
+
+	packet := rpcproto.Packet{
+		Method: rpcproto.Method_RigWarning,
+		Params: &rpcproto.Packet_RigWarning{
+			RigWarning: &rpcproto.RigWarningDetail{
+				MinerKey: minerKey,
+				Reason:   reason,
+			},
+		},
+	}
+	err := ctl.sendOrQueueMessage(&packet)
+	if err != nil {
+		ctl.log.Errorf("Unable to send RigWarning to MiningHQ: %s", err)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"testing"
+
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
+)
+
+func TestReapplyReplacedAssignment(t *testing.T) {
+	ctl := Ctl{
+		log: logrus.NewEntry(logrus.New()),
+	}
+	snapshot := &rpcproto.RigAssignmentRequest{}
+	newer := &rpcproto.RigAssignmentRequest{}
+	ctl.currentAssignment = snapshot
+
+	// A newer assignment is applied after the reconciler copied the
+	// current one
+	ctl.currentAssignment = newer
+
+	_, err := ctl.reapplyAssignment(snapshot)
+	if err != errAssignmentReplaced {
+		t.Fatalf("Expected errAssignmentReplaced, got %v", err)
+	}
+	if ctl.currentAssignment != newer {
+		t.Fatal("The newer assignment was overwritten")
+	}
+}
+
+func TestReapplyWithoutAssignment(t *testing.T) {
+	ctl := Ctl{
+		log: logrus.NewEntry(logrus.New()),
+	}
+	_, err := ctl.reapplyAssignment(nil)
+	if err != errAssignmentReplaced {
+		t.Fatalf("Expected errAssignmentReplaced, got %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/mininghq/miner-controller/src/miner"
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
+)
+
+// logLevelDefault clears the log level setting, the level set at startup
+// is restored
+const logLevelDefault = "default"
+
+// runtimeSettings are the settings MiningHQ can change without restarting
+// the controller, they are persisted in the state directory
+type runtimeSettings struct {
+	// StatsInterval is the time between stats submissions
+	StatsInterval time.Duration
+	// LogLevel of the controller, blank keeps the level set at startup.
+	// MiningHQ clears it by sending logLevelDefault
+	LogLevel string
+	// MinerLogLines is the number of output lines kept per miner
+	MinerLogLines int
+	// ErrorReportBurst is the number of errors and warnings reported per
+	// miner within ErrorReportInterval, the rest are dropped
+	ErrorReportBurst int
+	// ErrorReportInterval is the window for ErrorReportBurst
+	ErrorReportInterval time.Duration
+}
+
+// errorReportWindow counts the errors reported for a miner
+type errorReportWindow struct {
+	// start of the current window
+	start time.Time
+	// reported in the current window
+	reported int
+	// dropped in the current window
+	dropped int
+}
+
+// defaultSettings returns the settings used until MiningHQ sets others
+func defaultSettings() runtimeSettings {
+	return runtimeSettings{
+		StatsInterval:       conf.StatsSubmitInterval,
+		MinerLogLines:       conf.MinerLogLines,
+		ErrorReportBurst:    conf.ErrorReportBurst,
+		ErrorReportInterval: conf.ErrorReportInterval,
+	}
+}
+
+// settingsPath returns the path of the persisted settings file
+func (ctl *Ctl) settingsPath() string {
+	return filepath.Join(ctl.stateDir, "settings.json")
+}
+
+// getSettings returns the current runtime settings
+func (ctl *Ctl) getSettings() runtimeSettings {
+	ctl.settingsMutex.Lock()
+	defer ctl.settingsMutex.Unlock()
+	return ctl.settings
+}
+
+// handleSettings validates and applies the settings pushed by MiningHQ,
+// only the settings that are set are changed. The settings are persisted.
+// It returns the active settings
+func (ctl *Ctl) handleSettings(update *rpcproto.RigSettings) (runtimeSettings, error) {
+	settings := ctl.getSettings()
+
+	if update.StatsIntervalSeconds > 0 {
+		interval := time.Duration(update.StatsIntervalSeconds) * time.Second
+		if interval < conf.MinStatsSubmitInterval {
+			return ctl.getSettings(), fmt.Errorf(
+				"Stats interval %s is shorter than %s",
+				interval,
+				conf.MinStatsSubmitInterval)
+		}
+		settings.StatsInterval = interval
+	}
+	if update.LogLevel == logLevelDefault {
+		settings.LogLevel = ""
+	} else if update.LogLevel != "" {
+		_, err := logrus.ParseLevel(update.LogLevel)
+		if err != nil {
+			return ctl.getSettings(), err
+		}
+		settings.LogLevel = update.LogLevel
+	}
+	if update.MinerLogLines > 0 {
+		if update.MinerLogLines > conf.MaxMinerLogLines {
+			return ctl.getSettings(), fmt.Errorf(
+				"Miner log lines %d is more than %d",
+				update.MinerLogLines,
+				conf.MaxMinerLogLines)
+		}
+		settings.MinerLogLines = int(update.MinerLogLines)
+	}
+	if update.ErrorReportBurst > 0 {
+		settings.ErrorReportBurst = int(update.ErrorReportBurst)
+	}
+	if update.ErrorReportIntervalSeconds > 0 {
+		settings.ErrorReportInterval = time.Duration(update.ErrorReportIntervalSeconds) * time.Second
+	}
+
+	ctl.applySettings(settings)
+
+	err := ctl.saveSettings(settings)
+	if err != nil {
+		return settings, fmt.Errorf("Unable to save settings: %s", err)
+	}
+	return settings, nil
+}
+
+// applySettings makes the settings active
+func (ctl *Ctl) applySettings(settings runtimeSettings) {
+	ctl.settingsMutex.Lock()
+	intervalChanged := settings.StatsInterval != ctl.settings.StatsInterval
+	ctl.settings = settings
+	ctl.settingsMutex.Unlock()
+
+	// The stats wait for the new interval right away
+	if intervalChanged {
+		select {
+		case ctl.statsIntervalChanged <- struct{}{}:
+		default:
+		}
+	}
+
+	level := ctl.startupLogLevel
+	if settings.LogLevel != "" {
+		parsedLevel, err := logrus.ParseLevel(settings.LogLevel)
+		if err == nil {
+			level = parsedLevel
+		}
+	}
+	ctl.log.Logger.SetLevel(level)
+
+	ctl.mutex.Lock()
+	for _, activeMiner := range ctl.miners {
+		if sizer, ok := activeMiner.(miner.LogBufferSizer); ok {
+			sizer.SetLogBufferSize(settings.MinerLogLines)
+		}
+	}
+	ctl.mutex.Unlock()
+
+	ctl.log.WithFields(logrus.Fields{
+		"stats_interval":        settings.StatsInterval,
+		"log_level":             settings.LogLevel,
+		"miner_log_lines":       settings.MinerLogLines,
+		"error_report_burst":    settings.ErrorReportBurst,
+		"error_report_interval": settings.ErrorReportInterval,
+	}).Info("Runtime settings applied")
+}
+
+// saveSettings persists the settings
+func (ctl *Ctl) saveSettings(settings runtimeSettings) error {
+	settingsBytes, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ctl.settingsPath(), settingsBytes)
+}
+
+// loadSettings reads the persisted settings, the defaults are used for
+// anything not saved
+func (ctl *Ctl) loadSettings() (runtimeSettings, error) {
+	settings := defaultSettings()
+	settingsBytes, err := ioutil.ReadFile(ctl.settingsPath())
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	err = json.Unmarshal(settingsBytes, &settings)
+	if err != nil {
+		return defaultSettings(), err
+	}
+	return settings, nil
+}
+
+// pruneErrorReports forgets the error reports of the miners that are
+// gone. The caller must hold ctl.mutex
+func (ctl *Ctl) pruneErrorReports() {
+	activeKeys := make(map[string]bool)
+	for _, activeMiner := range ctl.miners {
+		activeKeys[activeMiner.GetKey()] = true
+	}
+
+	ctl.settingsMutex.Lock()
+	defer ctl.settingsMutex.Unlock()
+	for key := range ctl.errorReports {
+		if !activeKeys[key] {
+			delete(ctl.errorReports, key)
+		}
+	}
+}
+
+// allowErrorReport returns true if an error or warning of the miner may
+// be reported to MiningHQ. When a new window starts, it also returns the
+// number of reports dropped in the previous window
+func (ctl *Ctl) allowErrorReport(minerKey string) (bool, int) {
+	ctl.settingsMutex.Lock()
+	defer ctl.settingsMutex.Unlock()
+	settings := ctl.settings
+
+	window, exists := ctl.errorReports[minerKey]
+	if !exists {
+		window = &errorReportWindow{start: time.Now()}
+		ctl.errorReports[minerKey] = window
+	}
+	dropped := 0
+	if time.Since(window.start) >= settings.ErrorReportInterval {
+		dropped = window.dropped
+		*window = errorReportWindow{start: time.Now()}
+	}
+	if window.reported >= settings.ErrorReportBurst {
+		window.dropped++
+		return false, dropped
+	}
+	window.reported++
+	return true, dropped
+}
@@ -25,20 +25,23 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/mininghq/miner-controller/src/miner"
 	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
 )
 
 // handleControl handles new control messages from MiningHQ
 func (ctl *Ctl) handleControl(request *rpcproto.StateRequest) error {
 
-	if request.GetState() == rpcproto.MinerState_StopMining ||
-		request.GetState() == rpcproto.MinerState_PauseMining {
+	if request.GetState() == rpcproto.MinerState_StopMining {
 		ctl.log.WithField(
 			"state", request.GetState().String(),
 		).Info("Received new control state")
 		// If we were mining, we need to stop all the miners and remove their
 		// config files
 		ctl.log.Debug("Stopping all miners...")
+		ctl.applyMutex.Lock()
+		defer ctl.applyMutex.Unlock()
 		ctl.mutex.Lock()
 		defer ctl.mutex.Unlock()
 		for _, miner := range ctl.miners {
@@ -48,29 +51,126 @@ func (ctl *Ctl) handleControl(request *rpcproto.StateRequest) error {
 			}
 		}
 		ctl.miners = nil
-		ctl.currentState = request.GetState()
+		ctl.pruneErrorReports()
+		ctl.setState(request.GetState())
 		ctl.clearDiscordPresence()
 
+		// Persist the state, we must not start mining after a restart
+		err := ctl.saveState()
+		if err != nil {
+			ctl.log.Warningf("Unable to save the rig state: %s", err)
+		}
+
+	} else if request.GetState() == rpcproto.MinerState_PauseMining {
+		ctl.log.WithField(
+			"state", request.GetState().String(),
+		).Info("Received new control state")
+		ctl.applyMutex.Lock()
+		defer ctl.applyMutex.Unlock()
+		ctl.mutex.Lock()
+		defer ctl.mutex.Unlock()
+		ctl.miners = ctl.pauseMiners(ctl.miners)
+		ctl.pruneErrorReports()
+		ctl.setState(request.GetState())
+		ctl.clearDiscordPresence()
+
+		// Persist the state, we must not start mining after a restart
+		err := ctl.saveState()
+		if err != nil {
+			ctl.log.Warningf("Unable to save the rig state: %s", err)
+		}
+
 	} else if request.GetState() == rpcproto.MinerState_StartMining {
 		ctl.log.WithField(
 			"state", rpcproto.MinerState_StartMining.String(),
 		).Info("Received new control state")
 
 		// continue the current assignment if one is set
-		if ctl.currentAssignment != nil {
-			return ctl.handleAssignment(ctl.currentAssignment)
-		}
-		return errors.New("no assignment set")
+		return ctl.continueAssignment()
 	} else if request.GetState() == rpcproto.MinerState_ResumeMining {
 		ctl.log.WithField(
 			"state", rpcproto.MinerState_ResumeMining.String(),
 		).Info("Received new control state")
 
-		// continue the current assignment if one is set
-		if ctl.currentAssignment != nil {
-			return ctl.handleAssignment(ctl.currentAssignment)
-		}
-		return errors.New("no assignment set")
+		// continue the current assignment if one is set. Applying the
+		// assignment resumes the paused miners and starts the miners
+		// that were stopped instead of paused
+		return ctl.continueAssignment()
 	}
 	return nil
 }
+
+// continueAssignment applies the current assignment again. An assignment
+// that replaced it in the meantime started the miners already
+func (ctl *Ctl) continueAssignment() error {
+	ctl.mutex.Lock()
+	assignment := ctl.currentAssignment
+	ctl.mutex.Unlock()
+	if assignment == nil {
+		return errors.New("no assignment set")
+	}
+
+	_, err := ctl.reapplyAssignment(assignment)
+	if err == errAssignmentReplaced {
+		ctl.log.Debug("Assignment was replaced, the newer assignment is mining")
+		return nil
+	}
+	return err
+}
+
+// pauseMiners pauses the miners that support it and stops the rest. It
+// returns the paused miners, the caller must hold ctl.mutex
+func (ctl *Ctl) pauseMiners(miners []miner.Miner) []miner.Miner {
+	var pausedMiners []miner.Miner
+	for _, activeMiner := range miners {
+		log := ctl.log.WithFields(logrus.Fields{
+			"miner_key":  activeMiner.GetKey(),
+			"miner_type": activeMiner.GetType(),
+		})
+		if pauser, ok := activeMiner.(miner.Pauser); ok {
+			err := pauser.Pause()
+			if err == nil {
+				log.Debug("Miner paused")
+				pausedMiners = append(pausedMiners, activeMiner)
+				continue
+			}
+			if err != miner.ErrNotSupported {
+				log.Warningf("Unable to pause miner, stopping it: %s", err)
+			}
+		}
+		err := activeMiner.Stop()
+		if err != nil {
+			log.Warningf("Unable to stop miner cleanly: %s", err)
+		}
+	}
+	return pausedMiners
+}
+
+// resumeMiners resumes the paused miners. A miner that fails to resume
+// stays paused, the reconciler restarts it
+func (ctl *Ctl) resumeMiners(miners []miner.Miner) {
+	for _, activeMiner := range miners {
+		if !isPaused(activeMiner) {
+			continue
+		}
+		log := ctl.log.WithFields(logrus.Fields{
+			"miner_key":  activeMiner.GetKey(),
+			"miner_type": activeMiner.GetType(),
+		})
+		err := resumeMiner(activeMiner)
+		if err != nil {
+			log.Warningf("Unable to resume miner: %s", err)
+			continue
+		}
+		log.Debug("Miner resumed")
+	}
+}
+
+// resumeMiner resumes a paused miner
+func resumeMiner(activeMiner miner.Miner) error {
+	pauser, ok := activeMiner.(miner.Pauser)
+	if !ok {
+		return miner.ErrNotSupported
+	}
+	return pauser.Resume()
+}
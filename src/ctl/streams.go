@@ -0,0 +1,346 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
+)
+
+// The controller events streamed to the Miner Manager
+const (
+	// eventStateChanged is sent when the rig state changes
+	eventStateChanged = "state_changed"
+	// eventAssignmentProgress is sent for every assignment phase
+	eventAssignmentProgress = "assignment_progress"
+	// eventAssignmentApplied is sent once an assignment is running
+	eventAssignmentApplied = "assignment_applied"
+	// eventAssignmentFailed is sent when an assignment could not be applied
+	eventAssignmentFailed = "assignment_failed"
+	// eventMinerCrashed is sent when a miner exits unexpectedly
+	eventMinerCrashed = "miner_crashed"
+	// eventMinerError is sent for errors parsed from the miner output
+	eventMinerError = "miner_error"
+	// eventMinerWarning is sent for warnings parsed from the miner output
+	eventMinerWarning = "miner_warning"
+	// eventCorrection is sent when the reconciler corrected a miner
+	eventCorrection = "correction"
+	// eventMinerStarted is sent when a miner was started through the
+	// Manager API
+	eventMinerStarted = "miner_started"
+	// eventMinerStopped is sent when a miner was stopped through the
+	// Manager API
+	eventMinerStopped = "miner_stopped"
+	// eventMinerRestarted is sent when a miner was restarted through the
+	// Manager API
+	eventMinerRestarted = "miner_restarted"
+)
+
+// subscription receives the messages published to a broadcaster
+type subscription struct {
+	messages chan interface{}
+	// filter selects the messages for this subscription, nil for all
+	filter func(interface{}) bool
+	// dropped counts the messages missed since the last one received,
+	// it is accessed atomically
+	dropped uint32
+}
+
+// takeDropped returns the number of missed messages and resets it
+func (sub *subscription) takeDropped() uint32 {
+	return atomic.SwapUint32(&sub.dropped, 0)
+}
+
+// broadcaster fans out messages to the Manager API streams. Publishing
+// never blocks, subscribers that fall behind miss messages instead
+type broadcaster struct {
+	mutex       sync.Mutex
+	subscribers map[*subscription]struct{}
+	// last is the last message published
+	last interface{}
+}
+
+// newBroadcaster creates a broadcaster without subscribers
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		subscribers: make(map[*subscription]struct{}),
+	}
+}
+
+// subscribe returns a new subscription for the messages the filter
+// selects, nil selects all messages
+func (caster *broadcaster) subscribe(filter func(interface{}) bool) *subscription {
+	sub := subscription{
+		messages: make(chan interface{}, conf.StreamBufferSize),
+		filter:   filter,
+	}
+	caster.mutex.Lock()
+	caster.subscribers[&sub] = struct{}{}
+	caster.mutex.Unlock()
+	return &sub
+}
+
+// unsubscribe stops sending messages to the subscription
+func (caster *broadcaster) unsubscribe(sub *subscription) {
+	caster.mutex.Lock()
+	delete(caster.subscribers, sub)
+	caster.mutex.Unlock()
+}
+
+// publish sends the message to every subscriber with room for it
+func (caster *broadcaster) publish(message interface{}) {
+	caster.mutex.Lock()
+	defer caster.mutex.Unlock()
+	caster.last = message
+	for sub := range caster.subscribers {
+		if sub.filter != nil && !sub.filter(message) {
+			continue
+		}
+		select {
+		case sub.messages <- message:
+		default:
+			atomic.AddUint32(&sub.dropped, 1)
+		}
+	}
+}
+
+// latest returns the last message published, nil if none
+func (caster *broadcaster) latest() interface{} {
+	caster.mutex.Lock()
+	defer caster.mutex.Unlock()
+	return caster.last
+}
+
+// serveStream sends the messages of the subscription until the client
+// goes away or the controller stops
+func (ctl *Ctl) serveStream(
+	ctx context.Context,
+	sub *subscription,
+	send func(message interface{}, dropped uint32) error) error {
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ctl.shutdown:
+			return nil
+		case message := <-sub.messages:
+			err := send(message, sub.takeDropped())
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// setState changes the rig state and publishes the change, the caller
+// must hold ctl.mutex
+func (ctl *Ctl) setState(state rpcproto.MinerState) {
+	ctl.currentState = state
+	atomic.StoreInt32(&ctl.eventState, int32(state))
+	ctl.publishEvent(eventStateChanged, "", "")
+}
+
+// getEventState returns the rig state for the events without ctl.mutex
+func (ctl *Ctl) getEventState() rpcproto.MinerState {
+	return rpcproto.MinerState(atomic.LoadInt32(&ctl.eventState))
+}
+
+// publishEvent streams a controller event to the Miner Manager
+func (ctl *Ctl) publishEvent(eventType string, minerKey string, message string) {
+	ctl.eventStream.publish(&rpcproto.ControllerEvent{
+		Type:      eventType,
+		MinerKey:  minerKey,
+		State:     ctl.getEventState(),
+		Message:   message,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// minerLogHandler streams every new line of miner output. It is called
+// from the miner's output reader and must not block
+func (ctl *Ctl) minerLogHandler(minerKey string, line string) {
+	ctl.logStream.publish(&rpcproto.LogLine{
+		MinerKey:  minerKey,
+		Line:      line,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// WatchStats streams the stats of the miners each time they are collected
+func (ctl *Ctl) WatchStats(
+	request *rpcproto.WatchStatsRequest,
+	stream rpcproto.ManagerService_WatchStatsServer) error {
+
+	ctl.log.WithFields(logrus.Fields{
+		"method": "WatchStats",
+	}).Debug("New gRPC stream opened")
+
+	sub := ctl.statsStream.subscribe(nil)
+	defer ctl.statsStream.unsubscribe(sub)
+
+	// The client doesn't have to wait for the next collection
+	if latest := ctl.currentStats(); latest != nil {
+		err := stream.Send(latest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ctl.serveStream(stream.Context(), sub, func(message interface{}, dropped uint32) error {
+		// Missed samples are not of interest, the next one replaces them
+		return stream.Send(message.(*rpcproto.StatsResponse))
+	})
+}
+
+// currentStats returns the last stats sample if it is still current, nil
+// otherwise. The sample stays around after the rig stopped mining
+func (ctl *Ctl) currentStats() *rpcproto.StatsResponse {
+	latest, ok := ctl.statsStream.latest().(*rpcproto.StatsResponse)
+	if !ok {
+		return nil
+	}
+	ctl.mutex.Lock()
+	state := ctl.currentState
+	ctl.mutex.Unlock()
+	if state != rpcproto.MinerState_Mining {
+		return nil
+	}
+	if time.Since(time.Unix(latest.Timestamp, 0)) > ctl.getSettings().StatsInterval {
+		return nil
+	}
+	return latest
+}
+
+// TailLogs streams the new lines of miner output, of a single miner if
+// the request has a miner key. With Backlog set the buffered lines are
+// sent first
+func (ctl *Ctl) TailLogs(
+	request *rpcproto.TailLogsRequest,
+	stream rpcproto.ManagerService_TailLogsServer) error {
+
+	ctl.log.WithFields(logrus.Fields{
+		"method":    "TailLogs",
+		"miner_key": request.MinerKey,
+	}).Debug("New gRPC stream opened")
+
+	var filter func(interface{}) bool
+	if request.MinerKey != "" {
+		filter = func(message interface{}) bool {
+			return message.(*rpcproto.LogLine).MinerKey == request.MinerKey
+		}
+	}
+	// Subscribe before reading the buffers, a line written in between may
+	// be sent twice but none is missed
+	sub := ctl.logStream.subscribe(filter)
+	defer ctl.logStream.unsubscribe(sub)
+
+	if request.Backlog {
+		for _, minerLog := range ctl.getMinersLogs() {
+			if request.MinerKey != "" && minerLog.Key != request.MinerKey {
+				continue
+			}
+			for _, line := range minerLog.Logs {
+				err := stream.Send(&rpcproto.LogLine{
+					MinerKey: minerLog.Key,
+					Line:     line,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return ctl.serveStream(stream.Context(), sub, func(message interface{}, dropped uint32) error {
+		logLine := *message.(*rpcproto.LogLine)
+		logLine.Dropped = dropped
+		return stream.Send(&logLine)
+	})
+}
+
+// WatchEvents streams the controller events such as state changes,
+// assignment progress and miner crashes
+func (ctl *Ctl) WatchEvents(
+	request *rpcproto.WatchEventsRequest,
+	stream rpcproto.ManagerService_WatchEventsServer) error {
+
+	ctl.log.WithFields(logrus.Fields{
+		"method": "WatchEvents",
+	}).Debug("New gRPC stream opened")
+
+	sub := ctl.eventStream.subscribe(nil)
+	defer ctl.eventStream.unsubscribe(sub)
+
+	// The client learns the current state first
+	err := stream.Send(&rpcproto.ControllerEvent{
+		Type:      eventStateChanged,
+		State:     ctl.getEventState(),
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return ctl.serveStream(stream.Context(), sub, func(message interface{}, dropped uint32) error {
+		event := *message.(*rpcproto.ControllerEvent)
+		event.Dropped = dropped
+		return stream.Send(&event)
+	})
+}
+
+// progressEventType returns the event type for an assignment phase
+func progressEventType(phase string) string {
+	switch phase {
+	case phaseApplied:
+		return eventAssignmentApplied
+	case phaseFailed:
+		return eventAssignmentFailed
+	}
+	return eventAssignmentProgress
+}
+
+// progressEventMessage describes the assignment progress for an event
+func progressEventMessage(progress *rpcproto.AssignmentProgress) string {
+	message := progress.Phase
+	switch {
+	case progress.BytesTotal > 0:
+		message = fmt.Sprintf(
+			"%s (%d of %d bytes)",
+			message,
+			progress.BytesCompleted,
+			progress.BytesTotal)
+	case progress.BytesCompleted > 0:
+		message = fmt.Sprintf("%s (%d bytes, total unknown)", message, progress.BytesCompleted)
+	}
+	if progress.Reason != "" {
+		message = fmt.Sprintf("%s: %s", message, progress.Reason)
+	}
+	return message
+}
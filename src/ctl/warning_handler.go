@@ -0,0 +1,138 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"time"
+
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/mininghq/miner-controller/src/miner"
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/sirupsen/logrus"
+)
+
+// warningActionUpdateMiner asks the rig to update the miner named in the
+// warning, or all miners if no miner key is set
+const warningActionUpdateMiner = "update_miner"
+
+// handleWarning handles warnings from MiningHQ, for example about an
+// outdated miner or a pool rejecting shares
+func (ctl *Ctl) handleWarning(warning *rpcproto.RigWarningDetail) {
+	if warning.Timestamp == 0 {
+		warning.Timestamp = time.Now().Unix()
+	}
+
+	ctl.log.WithFields(logrus.Fields{
+		"miner_key": warning.MinerKey,
+		"action":    warning.Action,
+	}).Warningf("MiningHQ warning: %s", warning.Reason)
+
+	// Keep the latest warnings for the Miner Manager
+	ctl.warningsMutex.Lock()
+	ctl.warnings = append(ctl.warnings, warning)
+	if len(ctl.warnings) > conf.WarningsMaxCount {
+		ctl.warnings = ctl.warnings[len(ctl.warnings)-conf.WarningsMaxCount:]
+	}
+	ctl.warningsMutex.Unlock()
+
+	switch warning.Action {
+	case "":
+	case warningActionUpdateMiner:
+		go ctl.updateMiners(warning.MinerKey)
+	default:
+		ctl.log.WithField(
+			"action", warning.Action,
+		).Warning("Unknown warning action received")
+	}
+}
+
+// getWarnings returns the latest warnings received from MiningHQ
+func (ctl *Ctl) getWarnings() []*rpcproto.RigWarningDetail {
+	ctl.warningsMutex.Lock()
+	defer ctl.warningsMutex.Unlock()
+	warnings := make([]*rpcproto.RigWarningDetail, len(ctl.warnings))
+	copy(warnings, ctl.warnings)
+	return warnings
+}
+
+// updateMiners updates the miner with the key, or all miners if the key
+// is blank. Miners that don't support updates are skipped
+func (ctl *Ctl) updateMiners(minerKey string) {
+	// Updates are downloaded, don't block the other operations
+	var miners []miner.Miner
+	ctl.mutex.Lock()
+	for _, activeMiner := range ctl.miners {
+		if minerKey == "" || activeMiner.GetKey() == minerKey {
+			miners = append(miners, activeMiner)
+		}
+	}
+	ctl.mutex.Unlock()
+
+	if len(miners) == 0 {
+		ctl.log.WithField(
+			"miner_key", minerKey,
+		).Warning("No miner found to update")
+		return
+	}
+
+	for _, activeMiner := range miners {
+		log := ctl.log.WithFields(logrus.Fields{
+			"miner_key":  activeMiner.GetKey(),
+			"miner_type": activeMiner.GetType(),
+		})
+		updater, ok := activeMiner.(miner.Updater)
+		if !ok {
+			log.Warning("Miner does not support updates")
+			continue
+		}
+		// MiningHQ may repeat the warning while the update downloads
+		if !ctl.startUpdate(activeMiner.GetKey()) {
+			log.Debug("Miner is already being updated")
+			continue
+		}
+		log.Info("Updating miner as requested by MiningHQ")
+		err := updater.Update()
+		ctl.finishUpdate(activeMiner.GetKey())
+		if err != nil {
+			log.Errorf("Unable to update miner: %s", err)
+		}
+	}
+}
+
+// startUpdate marks the miner as being updated, it returns false if an
+// update of the miner is already in progress
+func (ctl *Ctl) startUpdate(minerKey string) bool {
+	ctl.updatesMutex.Lock()
+	defer ctl.updatesMutex.Unlock()
+	if ctl.updating[minerKey] {
+		return false
+	}
+	ctl.updating[minerKey] = true
+	return true
+}
+
+// finishUpdate clears the update in progress of the miner
+func (ctl *Ctl) finishUpdate(minerKey string) {
+	ctl.updatesMutex.Lock()
+	defer ctl.updatesMutex.Unlock()
+	delete(ctl.updating, minerKey)
+}
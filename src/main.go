@@ -37,6 +37,17 @@ import (
 // Config holds the environment variables for this service
 type Config struct {
 	Debug bool `split_words:"true"`
+	// ManagerEndpoint is the gRPC API endpoint used by the Miner Manager to
+	// communicate with the miner controller. Use 'unix:<path>' to serve
+	// it on a Unix socket, the TCP endpoint checks the manager_token
+	ManagerEndpoint string `split_words:"true" default:"localhost:64630"` // Port = MINE0
+	// ManagerTokenRequired denies the calls on the TCP endpoint that don't
+	// carry the manager_token. Off until the Miner Manager sends it, the
+	// endpoint must be a loopback address while it is off
+	ManagerTokenRequired bool `split_words:"true"`
+	// MetricsEndpoint is the HTTP endpoint to serve Prometheus metrics on
+	// at /metrics, such as 'localhost:9650'. Disabled if empty
+	MetricsEndpoint string `split_words:"true"`
 }
 
 func main() {
@@ -66,7 +77,7 @@ func main() {
 
 	// grpcEndpoint is the gRPC API endpoint used by the Miner Manager to
 	// communicate with the miner controller
-	grpcEndpoint := "localhost:64630" // Port = MINE0
+	grpcEndpoint := config.ManagerEndpoint
 	// websocketEndpoint is the websocket endpoint connection of MiningHQ
 	// to which we connect for command and control
 	websocketEndpoint := conf.WebsocketEndpoint
@@ -79,6 +90,10 @@ func main() {
 	// 		/mininghq-miner-controller
 	// 	/mining_key
 	// 	/rig_id
+	// 	/manager_token
+	// 	/state.json
+	// 	/settings.json
+	// 	/outbox
 
 	// executablePath is the full path to the binary
 	// /miner-controller/{version}/mininghq-miner-controller
@@ -107,7 +122,9 @@ func main() {
 		MaxBackups: 3,   // Keep a maximum of 3 logfiles
 		MaxAge:     3,   // Keep logfiles for a maximum of 3 days
 		// TODO: Add the lumberjack compression
-		Level:     logLevel,
+		// The logger level filters the entries, MiningHQ may change it
+		// at runtime
+		Level:     logrus.DebugLevel,
 		Formatter: &logOutputFormat,
 	})
 	if err != nil {
@@ -130,8 +147,11 @@ func main() {
 	controller, err := ctl.New(
 		websocketEndpoint,
 		grpcEndpoint,
+		config.ManagerTokenRequired,
+		config.MetricsEndpoint,
 		strings.TrimSpace(string(miningKey)),
 		strings.TrimSpace(string(rigID)),
+		basePath,
 		logger,
 	)
 	if err != nil {
@@ -42,6 +42,8 @@ type WebSocketClient struct {
 	conn *websocket.Conn
 	// pingTicker triggers the keep alive pings
 	pingTicker *time.Ticker
+	// stopPings is closed to stop the ping loop
+	stopPings chan struct{}
 	// onMessage is a callback when a new websocket message is received
 	onMessage func([]byte, error) error
 }
@@ -84,19 +86,30 @@ func NewWebSocketClient(
 	return &client, nil
 }
 
-// Start connects to the endpoint specified and runs the websocket client
+// Start runs the websocket client on the connection until it is closed
+// or a read fails
 func (client *WebSocketClient) Start() error {
 	defer client.conn.Close()
 
 	// Only start pinging after connected
 	client.Lock()
 	client.pingTicker = time.NewTicker(conf.PingInterval)
+	client.stopPings = make(chan struct{})
+	pingTicker := client.pingTicker
+	stopPings := client.stopPings
 	client.Unlock()
 	go func() {
-		for range client.pingTicker.C {
-			client.Ping()
+		for {
+			select {
+			case <-stopPings:
+				return
+			case <-pingTicker.C:
+				client.Ping()
+			}
 		}
 	}()
+	// The connection is done once we stop reading, stop pinging it
+	defer client.stopPinging()
 
 	err := client.conn.SetReadDeadline(time.Now().Add(conf.PongWait))
 	if err != nil {
@@ -112,16 +125,13 @@ func (client *WebSocketClient) Start() error {
 	})
 
 	for {
-		_, data, err := client.conn.ReadMessage()
-		err = client.onMessage(data, err)
-		if err != nil {
-			// switch err.(type) {
-			// case *websocket.CloseError:
-			// TODO: Find a way to repeatedly check if the MiningHQ websocket is back
-			// TODO: Check the error, if connection closed, retry connecting?
-			// default:
-			// }
-			return err
+		_, data, readErr := client.conn.ReadMessage()
+		// Errors processing a message are handled by onMessage, only
+		// read errors end the connection. The caller decides whether
+		// to reconnect
+		client.onMessage(data, readErr)
+		if readErr != nil {
+			return readErr
 		}
 	}
 }
@@ -139,8 +149,7 @@ func (client *WebSocketClient) WriteMessage(data []byte) error {
 	client.Lock()
 	defer client.Unlock()
 	if client.conn == nil {
-		// TODO: Handle
-		fmt.Println("NIL CONN!")
+		return fmt.Errorf("The websocket is not connected")
 	}
 	client.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
 	return client.conn.WriteMessage(websocket.TextMessage, data)
@@ -152,7 +161,7 @@ func (client *WebSocketClient) Stop() error {
 	defer client.Unlock()
 
 	// Stop sending pings
-	client.pingTicker.Stop()
+	client.stopPingingLocked()
 
 	// Cleanly close the connection by sending a close message
 	err := client.conn.WriteMessage(
@@ -164,3 +173,20 @@ func (client *WebSocketClient) Stop() error {
 
 	return nil
 }
+
+// stopPinging stops the keep alive pings
+func (client *WebSocketClient) stopPinging() {
+	client.Lock()
+	defer client.Unlock()
+	client.stopPingingLocked()
+}
+
+// stopPingingLocked stops the keep alive pings, the lock must be held
+func (client *WebSocketClient) stopPingingLocked() {
+	if client.pingTicker == nil {
+		return
+	}
+	client.pingTicker.Stop()
+	close(client.stopPings)
+	client.pingTicker = nil
+}
@@ -0,0 +1,607 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+
+	unattended "github.com/ProjectLimitless/go-unattended"
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/phayes/freeport"
+	"github.com/sirupsen/logrus"
+)
+
+// ExternalSpec describes how to run, configure and read stats from a miner
+// without a dedicated implementation
+//
+// All the string values are Go templates rendered with externalTemplateData
+type ExternalSpec struct {
+	// Type is the miner type MiningHQ uses in assignments
+	Type string `json:"type"`
+	// AppID is the Unattended application ID, ex. 'xmrig-mo-{{.OS}}'
+	AppID string `json:"app_id"`
+	// ApplicationName is the name of the miner binary
+	ApplicationName string `json:"application_name"`
+	// Arguments are passed to the miner binary
+	Arguments []string `json:"arguments"`
+	// ConfigExtension is the extension for the rendered config file,
+	// defaults to '.json'
+	ConfigExtension string `json:"config_extension"`
+	// ConfigTemplate is the config file template. Leave blank and blank
+	// ConfigTemplateFile if the miner is configured only by arguments
+	ConfigTemplate string `json:"config_template"`
+	// ConfigTemplateFile is the path to the config template, relative
+	// to the spec file
+	ConfigTemplateFile string `json:"config_template_file"`
+	// ErrorKeywords flag output lines to report to MiningHQ,
+	// defaults to 'error' and 'invalid'
+	ErrorKeywords []string `json:"error_keywords"`
+	// Stats describes how to read the stats from the miner's API
+	Stats ExternalStatsSpec `json:"stats"`
+}
+
+// ExternalStatsSpec maps the miner's JSON API response into MinerStats
+//
+// Each field holds a JSONPath-style expression, ex. '$.hashrate.total[0]'
+// Blank fields are not collected
+type ExternalStatsSpec struct {
+	// Endpoint is the HTTP JSON stats URL, ex. 'http://127.0.0.1:{{.APIPort}}/'
+	Endpoint string `json:"endpoint"`
+	// BearerAuth sends the AccessToken as a bearer token, the config
+	// template must set it as the miner's API token
+	BearerAuth        bool   `json:"bearer_auth"`
+	Hashrate          string `json:"hashrate"`
+	Hashrate60S       string `json:"hashrate_60s"`
+	Hashrate15M       string `json:"hashrate_15m"`
+	MaxHashrate       string `json:"max_hashrate"`
+	TotalHashes       string `json:"total_hashes"`
+	CurrentDifficulty string `json:"current_difficulty"`
+	TotalShares       string `json:"total_shares"`
+	AcceptedShares    string `json:"accepted_shares"`
+	RejectedShares    string `json:"rejected_shares"`
+	Pool              string `json:"pool"`
+	PoolPing          string `json:"pool_ping"`
+	PoolFailures      string `json:"pool_failures"`
+	// ThreadsHashrate should match one value per thread,
+	// ex. '$.hashrate.threads[*][0]'
+	ThreadsHashrate string `json:"threads_hashrate"`
+}
+
+// externalTemplateData is passed to all the templates in an ExternalSpec
+type externalTemplateData struct {
+	// Key is the miner's config key
+	Key string
+	// Algorithm to mine
+	Algorithm string
+	// Variant of the algorithm
+	Variant string
+	// PoolEndpoint is the primary pool host:port
+	PoolEndpoint string
+	// PoolUsername is the primary pool username, usually the wallet
+	PoolUsername string
+	// PoolPassword is the primary pool password
+	PoolPassword string
+	// Pools are all the pools in order of preference, including the primary
+	Pools []*rpcproto.PoolConfig
+	// Threads is the number of CPU threads to mine with
+	Threads int
+	// APIPort is a free port the miner must serve its API on
+	APIPort int
+	// AccessToken is a generated token for the miner's API
+	AccessToken string
+	// ConfigPath is the path of the rendered config file
+	ConfigPath string
+	// OS is the current operating system
+	OS string
+	// Arch is the current architecture
+	Arch string
+}
+
+// External implements the miner interface for any miner described
+// by an ExternalSpec
+type External struct {
+	spec ExternalSpec
+	// configPath might differ from the miner's location due to
+	// how MiningHQ's split mining is implemented
+	configPath    string
+	withUpdate    bool
+	updateWrapper *unattended.Unattended
+	process       *minerProcess
+	*minerOutput
+	statsEndpoint string
+
+	key     string
+	apiPort int
+	// accessToken is the generated token for the miner API
+	accessToken string
+}
+
+// LoadExternalSpecs reads all the '*.json' specs in the directory and
+// registers each as a miner type, YAML specs are not supported. A missing
+// directory is not an error. Invalid specs are skipped, the error lists
+// all of them
+func LoadExternalSpecs(specDir string) error {
+	specPaths, err := filepath.Glob(filepath.Join(specDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	// Only JSON specs are supported, tell the user why a YAML spec
+	// has no effect
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		yamlPaths, _ := filepath.Glob(filepath.Join(specDir, pattern))
+		for _, yamlPath := range yamlPaths {
+			logrus.Warningf("Skipped miner spec '%s': only JSON specs are supported", yamlPath)
+		}
+	}
+
+	var specErrors []string
+	for _, specPath := range specPaths {
+		spec, err := ReadExternalSpec(specPath)
+		if err != nil {
+			err = fmt.Errorf("Unable to read miner spec '%s': %s", specPath, err)
+		} else if IsRegistered(spec.Type) {
+			err = fmt.Errorf(
+				"Unable to register miner spec '%s': type '%s' already exists",
+				specPath,
+				spec.Type)
+		}
+		if err != nil {
+			logrus.Warningf("Skipped miner spec: %s", err)
+			specErrors = append(specErrors, err.Error())
+			continue
+		}
+		Register(spec.Type, func(
+			withUpdate bool,
+			basePath string,
+			configPath string,
+			config rpcproto.MinerConfig) (Miner, error) {
+			miner, err := NewExternal(spec, withUpdate, basePath, configPath, config)
+			if miner == nil {
+				// Avoid returning a typed nil as a Miner
+				return nil, err
+			}
+			return miner, err
+		})
+	}
+	if len(specErrors) > 0 {
+		return fmt.Errorf(
+			"%d of %d miner specs were skipped: %s",
+			len(specErrors),
+			len(specPaths),
+			strings.Join(specErrors, "; "))
+	}
+	return nil
+}
+
+// ReadExternalSpec reads and validates the miner spec at the path
+func ReadExternalSpec(specPath string) (ExternalSpec, error) {
+	var spec ExternalSpec
+
+	specBytes, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return spec, err
+	}
+	err = json.Unmarshal(specBytes, &spec)
+	if err != nil {
+		return spec, err
+	}
+
+	spec.Type = strings.ToLower(strings.TrimSpace(spec.Type))
+	if spec.Type == "" {
+		return spec, errors.New("type must not be blank")
+	}
+	if spec.AppID == "" {
+		return spec, errors.New("app_id must not be blank")
+	}
+	if spec.ApplicationName == "" {
+		return spec, errors.New("application_name must not be blank")
+	}
+	if spec.ConfigTemplateFile != "" {
+		templatePath := spec.ConfigTemplateFile
+		if !filepath.IsAbs(templatePath) {
+			templatePath = filepath.Join(filepath.Dir(specPath), templatePath)
+		}
+		templateBytes, err := ioutil.ReadFile(templatePath)
+		if err != nil {
+			return spec, fmt.Errorf("unable to read config template: %s", err)
+		}
+		spec.ConfigTemplate = string(templateBytes)
+	}
+	if spec.ConfigExtension == "" {
+		spec.ConfigExtension = ".json"
+	}
+	if len(spec.ErrorKeywords) == 0 {
+		spec.ErrorKeywords = []string{"error", "invalid"}
+	}
+
+	// Check all the paths now, not when the stats are requested
+	for _, path := range []string{
+		spec.Stats.Hashrate,
+		spec.Stats.Hashrate60S,
+		spec.Stats.Hashrate15M,
+		spec.Stats.MaxHashrate,
+		spec.Stats.TotalHashes,
+		spec.Stats.CurrentDifficulty,
+		spec.Stats.TotalShares,
+		spec.Stats.AcceptedShares,
+		spec.Stats.RejectedShares,
+		spec.Stats.Pool,
+		spec.Stats.PoolPing,
+		spec.Stats.PoolFailures,
+		spec.Stats.ThreadsHashrate,
+	} {
+		if path == "" {
+			continue
+		}
+		_, err = parsePath(path)
+		if err != nil {
+			return spec, err
+		}
+	}
+	return spec, nil
+}
+
+// NewExternal creates a new instance of a miner described by the spec
+//
+// It takes the spec, the unattended base path, the path to use for the config
+// and the configuration to use
+//
+// We configure the miner at construction
+func NewExternal(
+	spec ExternalSpec,
+	withUpdate bool,
+	basePath string,
+	configPath string,
+	config rpcproto.MinerConfig) (*External, error) {
+
+	log := logrus.WithFields(logrus.Fields{
+		"service": "unattended",
+		"miner":   spec.Type,
+	})
+	log.Info("Setting up Unattended updates")
+
+	accessToken, err := generateAccessToken()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate API access token: %s", err)
+	}
+
+	external := External{
+		spec:        spec,
+		accessToken: accessToken,
+		key:         config.Key,
+		withUpdate:  withUpdate,
+		configPath: strings.TrimSuffix(
+			configPath, filepath.Ext(configPath)) + spec.ConfigExtension,
+		minerOutput: newMinerOutput(config.Key, &keywordOutputParser{keywords: spec.ErrorKeywords}),
+	}
+
+	// The config file is removed again if creating the miner fails
+	data, err := external.configure(config)
+	if err != nil {
+		log.Errorf("Unable to configure miner: %s", err.Error())
+		external.removeConfig()
+		return nil, err
+	}
+
+	appID, err := renderTemplate("app_id", spec.AppID, data)
+	if err != nil {
+		external.removeConfig()
+		return nil, err
+	}
+	var parameters []string
+	for i, argument := range spec.Arguments {
+		parameter, err := renderTemplate(fmt.Sprintf("arguments[%d]", i), argument, data)
+		if err != nil {
+			external.removeConfig()
+			return nil, err
+		}
+		parameters = append(parameters, parameter)
+	}
+
+	target := unattended.Target{
+		VersionsPath:          basePath,
+		AppID:                 appID,
+		UpdateEndpoint:        conf.UnattendedBaseURL,
+		UpdateChannel:         "stable",
+		ApplicationName:       spec.ApplicationName,
+		ApplicationParameters: parameters,
+	}
+	external.updateWrapper, err = unattended.New(
+		"TEST001", // TODO clientID - miner key?
+		target,
+		time.Hour, // UpdateCheckInterval
+		log,
+	)
+	if err != nil {
+		external.removeConfig()
+		return nil, err
+	}
+	external.process = newMinerProcess(external.updateWrapper, withUpdate, target, log)
+	if external.withUpdate {
+		// During construction we check for any updates as well, this has the
+		// side effect that *if* the miner doesn't exist yet, it will be downloaded
+		_, err = external.updateWrapper.ApplyUpdates()
+	}
+	return &external, err
+}
+
+// configure the miner by rendering the config template. Once reconfigured,
+// the miner would need to be restarted
+func (miner *External) configure(
+	config rpcproto.MinerConfig) (externalTemplateData, error) {
+
+	data := externalTemplateData{
+		Key:        config.Key,
+		Algorithm:  config.Algorithm,
+		ConfigPath: miner.configPath,
+		OS:         strings.ToLower(runtime.GOOS),
+		Arch:       runtime.GOARCH,
+	}
+	if config.CPUConfig == nil {
+		return data, fmt.Errorf("You must provide a CPUConfig for %s", miner.spec.Type)
+	}
+	pools, err := poolConfigs(config)
+	if err != nil {
+		return data, err
+	}
+	data.Threads = int(config.CPUConfig.ThreadCount)
+	data.Variant = pools[0].Variant
+	data.PoolEndpoint = pools[0].Endpoint
+	data.PoolUsername = pools[0].Username
+	data.PoolPassword = pools[0].Password
+	data.Pools = pools
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		return data, fmt.Errorf("unable to create config: %s", err)
+	}
+	miner.apiPort = port
+	data.APIPort = port
+	data.AccessToken = miner.accessToken
+
+	if miner.spec.Stats.Endpoint != "" {
+		miner.statsEndpoint, err = renderTemplate(
+			"stats.endpoint", miner.spec.Stats.Endpoint, data)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	if miner.spec.ConfigTemplate == "" {
+		return data, nil
+	}
+	configContents, err := renderTemplate(
+		"config_template", miner.spec.ConfigTemplate, data)
+	if err != nil {
+		return data, err
+	}
+	return data, miner.writeConfig(configContents)
+}
+
+// Start the miner
+func (miner *External) Start() error {
+
+	outputWriter, err := miner.readOutput()
+	if err != nil {
+		return err
+	}
+	return miner.process.run(outputWriter)
+}
+
+// Stop the miner and remove the config files
+func (miner *External) Stop() error {
+	err := miner.process.stop(conf.MinerStopTimeout)
+	if err != nil {
+		return err
+	}
+	return miner.removeConfig()
+}
+
+// removeConfig removes the rendered config file, if the spec has one
+func (miner *External) removeConfig() error {
+	if miner.spec.ConfigTemplate == "" {
+		return nil
+	}
+	err := os.Remove(miner.configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Update installs a new version of the external miner if one is available
+func (miner *External) Update() error {
+	return miner.process.applyUpdate()
+}
+
+// Health returns the actual state of the miner
+func (miner *External) Health() Health {
+	health := miner.process.health(miner.configPath)
+	health.APIPort = miner.apiPort
+	return health
+}
+
+// GetType returns the miner type
+func (miner *External) GetType() string {
+	return miner.spec.Type
+}
+
+// GetKey returns the miner's config key
+func (miner *External) GetKey() string {
+	return miner.key
+}
+
+// GetStats returns the mining stats in a uniform format using the
+// spec's stats mapping
+func (miner *External) GetStats() (rpcproto.MinerStats, error) {
+
+	var stats rpcproto.MinerStats
+	stats.Key = miner.key
+
+	if miner.statsEndpoint == "" {
+		return stats, fmt.Errorf("%s has no stats endpoint", miner.spec.Type)
+	}
+
+	token := ""
+	if miner.spec.Stats.BearerAuth {
+		token = miner.accessToken
+	}
+	var document interface{}
+	err := getStatsJSON(miner.statsEndpoint, token, &document)
+	if err != nil {
+		return stats, err
+	}
+
+	mapping := miner.spec.Stats
+	var value float64
+	if mapping.Hashrate != "" {
+		if value, err = lookupFloat(document, mapping.Hashrate); err != nil {
+			return stats, err
+		}
+		stats.Hashrate = value
+	}
+	if mapping.Hashrate60S != "" {
+		if value, err = lookupFloat(document, mapping.Hashrate60S); err != nil {
+			return stats, err
+		}
+		stats.Hashrate60S = value
+	}
+	if mapping.Hashrate15M != "" {
+		if value, err = lookupFloat(document, mapping.Hashrate15M); err != nil {
+			return stats, err
+		}
+		stats.Hashrate15M = value
+	}
+	if mapping.MaxHashrate != "" {
+		if value, err = lookupFloat(document, mapping.MaxHashrate); err != nil {
+			return stats, err
+		}
+		stats.MaxHashrate = value
+	}
+	if mapping.TotalHashes != "" {
+		if value, err = lookupFloat(document, mapping.TotalHashes); err != nil {
+			return stats, err
+		}
+		stats.TotalHashes = uint64(value)
+	}
+	if mapping.CurrentDifficulty != "" {
+		if value, err = lookupFloat(document, mapping.CurrentDifficulty); err != nil {
+			return stats, err
+		}
+		stats.CurrentDifficulty = uint64(value)
+	}
+	if mapping.TotalShares != "" {
+		if value, err = lookupFloat(document, mapping.TotalShares); err != nil {
+			return stats, err
+		}
+		stats.TotalShares = uint32(value)
+	}
+	if mapping.AcceptedShares != "" {
+		if value, err = lookupFloat(document, mapping.AcceptedShares); err != nil {
+			return stats, err
+		}
+		stats.AcceptedShares = uint32(value)
+	}
+	if mapping.RejectedShares != "" {
+		if value, err = lookupFloat(document, mapping.RejectedShares); err != nil {
+			return stats, err
+		}
+		stats.RejectedShares = uint32(value)
+	} else if stats.TotalShares >= stats.AcceptedShares {
+		stats.RejectedShares = stats.TotalShares - stats.AcceptedShares
+	}
+
+	if mapping.Pool != "" {
+		if stats.Pool, err = lookupString(document, mapping.Pool); err != nil {
+			return stats, err
+		}
+	}
+	if mapping.PoolPing != "" {
+		if value, err = lookupFloat(document, mapping.PoolPing); err != nil {
+			return stats, err
+		}
+		stats.PoolPing = uint32(value)
+	}
+	if mapping.PoolFailures != "" {
+		if value, err = lookupFloat(document, mapping.PoolFailures); err != nil {
+			return stats, err
+		}
+		stats.PoolFailures = uint32(value)
+	}
+
+	if mapping.ThreadsHashrate != "" {
+		threads, err := lookupFloats(document, mapping.ThreadsHashrate)
+		if err != nil {
+			return stats, err
+		}
+		cpuStats := rpcproto.CPUStats{
+			ThreadsHashrate: threads,
+		}
+		stats.CPUs = append(stats.CPUs, &cpuStats)
+	}
+	return stats, nil
+}
+
+// GetVersion returns the latest version currently running
+func (miner *External) GetVersion() string {
+	return miner.updateWrapper.GetLatestVersion()
+}
+
+// writeConfig writes the rendered config to the drive
+func (miner *External) writeConfig(contents string) error {
+	return ioutil.WriteFile(miner.configPath, []byte(contents), 0644)
+}
+
+// renderTemplate renders a single spec template with the data
+func renderTemplate(
+	name string,
+	text string,
+	data externalTemplateData) (string, error) {
+
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		// json encodes a value, useful for strings in JSON config templates
+		"json": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+	}).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse template %s: %s", name, err)
+	}
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, data)
+	if err != nil {
+		return "", fmt.Errorf("unable to render template %s: %s", name, err)
+	}
+	return rendered.String(), nil
+}
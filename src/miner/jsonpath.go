@@ -0,0 +1,170 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is a single step in a JSON path, either an object key,
+// an array index or a wildcard over all array elements
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parsePath parses a JSONPath-style expression such as
+// '$.hashrate.total[0]' or 'hashrate.threads[*][0]'. A bare '$' is the
+// root of the document, for APIs that return a single value
+func parsePath(path string) ([]pathSegment, error) {
+	path = strings.TrimSpace(path)
+	if path == "$" {
+		return nil, nil
+	}
+	path = strings.TrimPrefix(path, "$")
+	path = strings.TrimPrefix(path, ".")
+
+	var segments []pathSegment
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			return nil, fmt.Errorf("invalid path '%s': empty segment", path)
+		}
+		key := part
+		brackets := ""
+		if open := strings.Index(part, "["); open != -1 {
+			key = part[:open]
+			brackets = part[open:]
+		}
+		if key != "" {
+			segments = append(segments, pathSegment{key: key})
+		}
+		for brackets != "" {
+			end := strings.Index(brackets, "]")
+			if !strings.HasPrefix(brackets, "[") || end == -1 {
+				return nil, fmt.Errorf("invalid path '%s': unbalanced brackets", path)
+			}
+			value := brackets[1:end]
+			brackets = brackets[end+1:]
+			if value == "*" {
+				segments = append(segments, pathSegment{wildcard: true})
+				continue
+			}
+			index, err := strconv.Atoi(value)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid path '%s': bad index '%s'", path, value)
+			}
+			segments = append(segments, pathSegment{index: index, isIndex: true})
+		}
+	}
+	return segments, nil
+}
+
+// lookupPath evaluates the path against the decoded JSON document and
+// returns all the matching values. Missing keys and indexes out of range
+// match nothing instead of failing, miners only populate some fields
+// once they are up and running
+func lookupPath(document interface{}, path string) ([]interface{}, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []interface{}{document}
+	for _, segment := range segments {
+		var next []interface{}
+		for _, value := range values {
+			switch {
+			case segment.wildcard:
+				if array, ok := value.([]interface{}); ok {
+					next = append(next, array...)
+				}
+			case segment.isIndex:
+				if array, ok := value.([]interface{}); ok && segment.index < len(array) {
+					next = append(next, array[segment.index])
+				}
+			default:
+				if object, ok := value.(map[string]interface{}); ok {
+					if child, exists := object[segment.key]; exists {
+						next = append(next, child)
+					}
+				}
+			}
+		}
+		values = next
+	}
+	return values, nil
+}
+
+// lookupFloat returns the first value at the path as a float64
+func lookupFloat(document interface{}, path string) (float64, error) {
+	values, err := lookupPath(document, path)
+	if err != nil || len(values) == 0 {
+		return 0, err
+	}
+	return toFloat(values[0]), nil
+}
+
+// lookupString returns the first value at the path as a string
+func lookupString(document interface{}, path string) (string, error) {
+	values, err := lookupPath(document, path)
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	if text, ok := values[0].(string); ok {
+		return text, nil
+	}
+	return fmt.Sprint(values[0]), nil
+}
+
+// lookupFloats returns all the values at the path as float64s
+func lookupFloats(document interface{}, path string) ([]float64, error) {
+	values, err := lookupPath(document, path)
+	if err != nil {
+		return nil, err
+	}
+	var floats []float64
+	for _, value := range values {
+		floats = append(floats, toFloat(value))
+	}
+	return floats, nil
+}
+
+// toFloat converts a decoded JSON value to a float64, anything that is not
+// a number becomes zero
+func toFloat(value interface{}) float64 {
+	switch typed := value.(type) {
+	case json.Number:
+		number, _ := typed.Float64()
+		return number
+	case float64:
+		return typed
+	case string:
+		number, _ := strconv.ParseFloat(typed, 64)
+		return number
+	}
+	return 0
+}
@@ -0,0 +1,195 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDocument is a trimmed down xmrig API response
+const testDocument = `{
+	"hashrate": {
+		"total": [512.5, 498.25, null],
+		"highest": 530,
+		"threads": [[128.5, 120], [130, 125.5]]
+	},
+	"connection": {
+		"pool": "pool.example.com:3333",
+		"ping": "42"
+	},
+	"results": {
+		"shares_good": 10
+	}
+}`
+
+func decodeTestDocument(t *testing.T) interface{} {
+	var document interface{}
+	decoder := json.NewDecoder(strings.NewReader(testDocument))
+	decoder.UseNumber()
+	err := decoder.Decode(&document)
+	if err != nil {
+		t.Fatalf("Unable to decode test document: %s", err)
+	}
+	return document
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []pathSegment
+		invalid  bool
+	}{
+		{"$.hashrate.total[0]", []pathSegment{
+			{key: "hashrate"}, {key: "total"}, {index: 0, isIndex: true},
+		}, false},
+		{"hashrate.threads[*][1]", []pathSegment{
+			{key: "hashrate"}, {key: "threads"}, {wildcard: true}, {index: 1, isIndex: true},
+		}, false},
+		{"$[2]", []pathSegment{{index: 2, isIndex: true}}, false},
+		{"$", nil, false},
+		{"", nil, true},
+		{"hashrate..total", nil, true},
+		{"hashrate.total[0", nil, true},
+		{"hashrate.total[-1]", nil, true},
+		{"hashrate.total[a]", nil, true},
+	}
+	for _, test := range tests {
+		segments, err := parsePath(test.path)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parsePath(%q) expected an error", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePath(%q) returned error: %s", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(segments, test.expected) {
+			t.Errorf("parsePath(%q) = %+v, expected %+v", test.path, segments, test.expected)
+		}
+	}
+}
+
+func TestLookupFloat(t *testing.T) {
+	document := decodeTestDocument(t)
+	tests := []struct {
+		path     string
+		expected float64
+	}{
+		{"$.hashrate.total[0]", 512.5},
+		{"hashrate.total[1]", 498.25},
+		// null and missing values are zero
+		{"hashrate.total[2]", 0},
+		{"hashrate.total[5]", 0},
+		{"hashrate.missing", 0},
+		{"hashrate.highest", 530},
+		// Numbers in strings are parsed
+		{"connection.ping", 42},
+		{"hashrate.threads[1][1]", 125.5},
+	}
+	for _, test := range tests {
+		value, err := lookupFloat(document, test.path)
+		if err != nil {
+			t.Errorf("lookupFloat(%q) returned error: %s", test.path, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("lookupFloat(%q) = %v, expected %v", test.path, value, test.expected)
+		}
+	}
+}
+
+func TestLookupFloats(t *testing.T) {
+	document := decodeTestDocument(t)
+	tests := []struct {
+		path     string
+		expected []float64
+	}{
+		{"hashrate.threads[*][0]", []float64{128.5, 130}},
+		{"hashrate.total[*]", []float64{512.5, 498.25, 0}},
+		{"hashrate.threads[*][9]", nil},
+		{"results[*]", nil},
+	}
+	for _, test := range tests {
+		values, err := lookupFloats(document, test.path)
+		if err != nil {
+			t.Errorf("lookupFloats(%q) returned error: %s", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("lookupFloats(%q) = %v, expected %v", test.path, values, test.expected)
+		}
+	}
+}
+
+func TestLookupString(t *testing.T) {
+	document := decodeTestDocument(t)
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"connection.pool", "pool.example.com:3333"},
+		{"results.shares_good", "10"},
+		{"connection.missing", ""},
+	}
+	for _, test := range tests {
+		value, err := lookupString(document, test.path)
+		if err != nil {
+			t.Errorf("lookupString(%q) returned error: %s", test.path, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("lookupString(%q) = %q, expected %q", test.path, value, test.expected)
+		}
+	}
+}
+
+func TestLookupRoot(t *testing.T) {
+	// Some miner APIs only return the hashrate
+	var document interface{}
+	decoder := json.NewDecoder(strings.NewReader("1234.5"))
+	decoder.UseNumber()
+	err := decoder.Decode(&document)
+	if err != nil {
+		t.Fatalf("Unable to decode test document: %s", err)
+	}
+
+	value, err := lookupFloat(document, "$")
+	if err != nil {
+		t.Fatalf("lookupFloat(\"$\") returned error: %s", err)
+	}
+	if value != 1234.5 {
+		t.Errorf("lookupFloat(\"$\") = %v, expected 1234.5", value)
+	}
+}
+
+func TestLookupInvalidPath(t *testing.T) {
+	document := decodeTestDocument(t)
+	_, err := lookupPath(document, "hashrate.total[")
+	if err == nil {
+		t.Error("lookupPath with an invalid path expected an error")
+	}
+}
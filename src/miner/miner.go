@@ -21,7 +21,16 @@
 
 package miner
 
-import "github.com/mininghq/rpcproto/rpcproto"
+import (
+	"errors"
+	"time"
+
+	"github.com/mininghq/rpcproto/rpcproto"
+)
+
+// ErrNotSupported is returned when a miner doesn't support an
+// optional capability
+var ErrNotSupported = errors.New("not supported by this miner")
 
 // Miner interface defines the required behaviour for all cryptocurrency miners
 type Miner interface {
@@ -39,7 +48,77 @@ type Miner interface {
 	GetLogs() []string
 	// GetVersion returns the latest version currently running
 	GetVersion() string
-	// SetErrorHandler sets the handler to send any errors to
-	// It takes the miner key and the string containing the error
-	SetErrorHandler(func(string, string))
+	// SetErrorHandler sets the handler to send any errors and warnings to
+	// It takes the miner key and the event parsed from the miner output
+	SetErrorHandler(func(string, OutputEvent))
+}
+
+// Updater is implemented by miners that can update themselves on request
+type Updater interface {
+	// Update checks for and applies a new version of the miner, the
+	// miner is restarted if it was updated
+	Update() error
+}
+
+// Pauser is implemented by miners that can pause mining without stopping
+// the process, resuming avoids the cost of restarting the miner
+type Pauser interface {
+	// Pause mining, the process keeps running
+	Pause() error
+	// Resume mining after Pause
+	Resume() error
+}
+
+// Reconfigurer is implemented by miners that can apply a new config
+// without restarting
+type Reconfigurer interface {
+	// Reconfigure applies the config to the running miner, the miner
+	// key must not change
+	Reconfigure(config rpcproto.MinerConfig) error
+}
+
+// LogBufferSizer is implemented by miners that can change how many lines
+// of output they keep for GetLogs
+type LogBufferSizer interface {
+	// SetLogBufferSize sets the number of lines kept, older lines are
+	// dropped
+	SetLogBufferSize(lines int)
+}
+
+// LogTailer is implemented by miners that can report each line of output
+// as it is written
+type LogTailer interface {
+	// SetLogHandler sets the handler to send every new output line to,
+	// it takes the miner key and the line. It must not block
+	SetLogHandler(logHandler func(string, string))
+}
+
+// Health describes the actual state of a miner
+type Health struct {
+	// Running is set while the miner process is running
+	Running bool
+	// Uptime of the miner process, 0 if not running
+	Uptime time.Duration
+	// PID of the miner process, 0 if not running
+	PID int
+	// APIPort is the local port of the miner API, 0 if it has none
+	APIPort int
+	// ConfigMissing is set when a config file of the miner was removed
+	ConfigMissing bool
+	// Paused is set while the miner is paused through Pause
+	Paused bool
+	// Supervised is set while a supervisor keeps the miner running, it is
+	// cleared once the supervisor gave up
+	Supervised bool
+	// GaveUpAt is when the supervisor gave up, zero if it didn't
+	GaveUpAt time.Time
+	// Stopped is set once the supervisor was stopped, the miner is not
+	// started again
+	Stopped bool
+}
+
+// HealthChecker is implemented by miners that can report their health
+type HealthChecker interface {
+	// Health returns the actual state of the miner
+	Health() Health
 }
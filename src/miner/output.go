@@ -0,0 +1,482 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mininghq/miner-controller/src/conf"
+)
+
+// Severity of a miner output event
+type Severity int
+
+const (
+	// SeverityInfo is normal operation, ex. an accepted share
+	SeverityInfo Severity = iota
+	// SeverityWarning needs attention but the miner keeps working,
+	// ex. a rejected share or a lost pool connection
+	SeverityWarning
+	// SeverityError means the miner is not working correctly
+	SeverityError
+	// SeverityFatal means the miner can't run, ex. an invalid config
+	SeverityFatal
+)
+
+// String returns the name of the severity
+func (severity Severity) String() string {
+	switch severity {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	case SeverityFatal:
+		return "fatal"
+	}
+	return "unknown"
+}
+
+// OutputEventType is the kind of event parsed from the miner output
+type OutputEventType int
+
+const (
+	// EventError is an error that doesn't match a more specific type
+	EventError OutputEventType = iota
+	// EventShareAccepted is a share accepted by the pool
+	EventShareAccepted
+	// EventShareRejected is a share rejected by the pool
+	EventShareRejected
+	// EventNewJob is a new job received from the pool
+	EventNewJob
+	// EventPoolConnected is a (re)connection to a pool
+	EventPoolConnected
+	// EventPoolDisconnected is a lost or failed pool connection
+	EventPoolDisconnected
+	// EventHugePages reports the huge pages status
+	EventHugePages
+	// EventConfigError is a fatal configuration error
+	EventConfigError
+)
+
+// String returns the name of the event type
+func (eventType OutputEventType) String() string {
+	switch eventType {
+	case EventError:
+		return "error"
+	case EventShareAccepted:
+		return "share_accepted"
+	case EventShareRejected:
+		return "share_rejected"
+	case EventNewJob:
+		return "new_job"
+	case EventPoolConnected:
+		return "pool_connected"
+	case EventPoolDisconnected:
+		return "pool_disconnected"
+	case EventHugePages:
+		return "huge_pages"
+	case EventConfigError:
+		return "config_error"
+	}
+	return "unknown"
+}
+
+// OutputEvent is a typed event parsed from a line of miner output
+type OutputEvent struct {
+	// Type of the event
+	Type OutputEventType
+	// Severity of the event
+	Severity Severity
+	// Line is the output line without colour codes
+	Line string
+	// Reason is the error or rejection reason, if any
+	Reason string
+	// Pool is the pool the event relates to, if known
+	Pool string
+	// Algorithm of a new job, if known
+	Algorithm string
+	// Difficulty of the share or job
+	Difficulty uint64
+	// Latency is the time the pool took to respond to a share
+	Latency time.Duration
+	// AcceptedShares is the number of accepted shares so far, if known
+	AcceptedShares uint64
+	// RejectedShares is the number of rejected shares so far, if known
+	RejectedShares uint64
+	// HugePagesEnabled is set if huge pages are in use
+	HugePagesEnabled bool
+	// HugePagesPercent is the percentage of memory using huge pages,
+	// -1 if unknown
+	HugePagesPercent int
+}
+
+// OutputParser parses lines of miner output into events
+type OutputParser interface {
+	// Parse returns the event for the line, false if the line is not
+	// an event
+	Parse(line string) (OutputEvent, bool)
+}
+
+// colorCodes matches ANSI colour and style escape sequences
+var colorCodes = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+// minerOutput reads the output of a miner process. It keeps the latest
+// lines for GetLogs, streams every line to the log handler and reports
+// the errors and warnings found by the parser
+type minerOutput struct {
+	minerKey     string
+	parser       OutputParser
+	errorHandler func(string, OutputEvent)
+	logHandler   func(string, string)
+
+	// logMutex protects logList and logMax
+	logMutex sync.Mutex
+	logList  *list.List
+	logMax   int
+}
+
+// newMinerOutput creates the output reader for the miner with the key
+func newMinerOutput(minerKey string, parser OutputParser) *minerOutput {
+	return &minerOutput{
+		minerKey: minerKey,
+		parser:   parser,
+		logList:  list.New(),
+		logMax:   conf.MinerLogLines,
+	}
+}
+
+// readOutput returns the writer for the process output, every line
+// written is read in the background
+func (output *minerOutput) readOutput() (io.WriteCloser, error) {
+	if output.errorHandler == nil {
+		return nil, errors.New("error handler is nil, it must be set using SetErrorHandler")
+	}
+
+	outputReader, outputWriter := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(outputReader)
+		for scanner.Scan() {
+			line := stripColors(scanner.Text())
+			output.logMutex.Lock()
+			output.logList.PushBack(line)
+			if output.logList.Len() >= output.logMax {
+				output.logList.Remove(output.logList.Front())
+			}
+			output.logMutex.Unlock()
+			if output.logHandler != nil {
+				output.logHandler(output.minerKey, line)
+			}
+
+			// Check if we got any errors
+			// We do it by reading the logs because errors are not *always*
+			// available via an API
+			event, isEvent := output.parser.Parse(line)
+			if isEvent && event.Severity >= SeverityWarning {
+				output.errorHandler(output.minerKey, event)
+			}
+		}
+	}()
+	return outputWriter, nil
+}
+
+// SetErrorHandler sets the handler to send any errors and warnings to
+// It takes the miner key and the event parsed from the output
+func (output *minerOutput) SetErrorHandler(errorHandler func(string, OutputEvent)) {
+	output.errorHandler = errorHandler
+}
+
+// SetLogHandler sets the handler to send every new output line to
+// It takes the miner key and the line
+func (output *minerOutput) SetLogHandler(logHandler func(string, string)) {
+	output.logHandler = logHandler
+}
+
+// SetLogBufferSize sets the number of output lines kept for GetLogs
+func (output *minerOutput) SetLogBufferSize(lines int) {
+	output.logMutex.Lock()
+	defer output.logMutex.Unlock()
+	output.logMax = lines
+	for output.logList.Len() >= output.logMax && output.logList.Len() > 0 {
+		output.logList.Remove(output.logList.Front())
+	}
+}
+
+// GetLogs returns the last logs from the actual miner
+func (output *minerOutput) GetLogs() []string {
+	// Get all the logs and return them in the current order
+	output.logMutex.Lock()
+	defer output.logMutex.Unlock()
+
+	var logs []string
+	for item := output.logList.Front(); item != nil; item = item.Next() {
+		log := item.Value.(string)
+		logs = append(logs, log)
+	}
+	return logs
+}
+
+// stripColors removes the ANSI colour codes from the line
+func stripColors(line string) string {
+	return colorCodes.ReplaceAllString(line, "")
+}
+
+// parseUint returns the number in the string, 0 if not a number
+func parseUint(number string) uint64 {
+	value, _ := strconv.ParseUint(number, 10, 64)
+	return value
+}
+
+// parseMilliseconds returns the duration for a number of milliseconds
+func parseMilliseconds(milliseconds string) time.Duration {
+	return time.Duration(parseUint(milliseconds)) * time.Millisecond
+}
+
+// xmrigOutputParser parses xmrig output, it handles both the 2.x output
+// and the later output prefixed with the backend tag
+type xmrigOutputParser struct{}
+
+var (
+	xmrigAccepted = regexp.MustCompile(
+		`accepted \((\d+)/(\d+)\) diff (\d+)(?:.*)\((\d+) ms\)`)
+	xmrigRejected = regexp.MustCompile(
+		`rejected \((\d+)/(\d+)\) diff (\d+) "([^"]*)"(?:.*)\((\d+) ms\)`)
+	xmrigNewJob = regexp.MustCompile(
+		`new job from (\S+) diff (\d+)(?: algo (\S+))?`)
+	xmrigUsePool = regexp.MustCompile(
+		`use pool (\S+)`)
+	xmrigPoolError = regexp.MustCompile(
+		`\[?([^\s\[\]]+:\d+)\]? (?:(\w+) )?error(?: code)?:? (.*)$`)
+	xmrigHugePagesStatus = regexp.MustCompile(
+		`(?i)huge pages:?\s+(available, enabled|available, disabled|unavailable|supported|unsupported|disabled|permission granted|permission denied)`)
+	xmrigHugePagesPercent = regexp.MustCompile(
+		`huge pages (\d+)%`)
+	xmrigConfigError = regexp.MustCompile(
+		`(?i)(JSON decode failed|no valid configuration found|unknown algo|failed to start|not enough memory)`)
+)
+
+// Parse returns the event for the xmrig output line
+func (parser *xmrigOutputParser) Parse(line string) (OutputEvent, bool) {
+	event := OutputEvent{
+		Line:             line,
+		HugePagesPercent: -1,
+	}
+
+	if match := xmrigAccepted.FindStringSubmatch(line); match != nil {
+		event.Type = EventShareAccepted
+		event.Severity = SeverityInfo
+		event.AcceptedShares = parseUint(match[1])
+		event.RejectedShares = parseUint(match[2])
+		event.Difficulty = parseUint(match[3])
+		event.Latency = parseMilliseconds(match[4])
+		return event, true
+	}
+	if match := xmrigRejected.FindStringSubmatch(line); match != nil {
+		event.Type = EventShareRejected
+		event.Severity = SeverityWarning
+		event.AcceptedShares = parseUint(match[1])
+		event.RejectedShares = parseUint(match[2])
+		event.Difficulty = parseUint(match[3])
+		event.Reason = match[4]
+		event.Latency = parseMilliseconds(match[5])
+		return event, true
+	}
+	if match := xmrigNewJob.FindStringSubmatch(line); match != nil {
+		event.Type = EventNewJob
+		event.Severity = SeverityInfo
+		event.Pool = match[1]
+		event.Difficulty = parseUint(match[2])
+		event.Algorithm = match[3]
+		return event, true
+	}
+	if match := xmrigUsePool.FindStringSubmatch(line); match != nil {
+		event.Type = EventPoolConnected
+		event.Severity = SeverityInfo
+		event.Pool = match[1]
+		return event, true
+	}
+	if match := xmrigPoolError.FindStringSubmatch(line); match != nil {
+		event.Type = EventPoolDisconnected
+		event.Severity = SeverityWarning
+		event.Pool = match[1]
+		event.Reason = strings.Trim(match[3], `"`)
+		if match[2] != "" {
+			event.Reason = match[2] + " error: " + event.Reason
+		}
+		return event, true
+	}
+	if match := xmrigHugePagesPercent.FindStringSubmatch(line); match != nil {
+		event.Type = EventHugePages
+		event.HugePagesPercent = int(parseUint(match[1]))
+		event.HugePagesEnabled = event.HugePagesPercent > 0
+		event.Severity = SeverityInfo
+		if event.HugePagesPercent < 100 {
+			event.Severity = SeverityWarning
+			event.Reason = "Huge pages are not fully available, the hashrate will be lower"
+		}
+		return event, true
+	}
+	if match := xmrigHugePagesStatus.FindStringSubmatch(line); match != nil {
+		status := strings.ToLower(match[1])
+		event.Type = EventHugePages
+		event.HugePagesEnabled = status == "available, enabled" ||
+			status == "supported" ||
+			status == "permission granted"
+		event.Severity = SeverityInfo
+		if !event.HugePagesEnabled {
+			event.Severity = SeverityWarning
+			event.Reason = "Huge pages are " + status + ", the hashrate will be lower"
+		}
+		return event, true
+	}
+	if match := xmrigConfigError.FindStringSubmatch(line); match != nil {
+		event.Type = EventConfigError
+		event.Severity = SeverityFatal
+		event.Reason = line
+		return event, true
+	}
+	return parseGenericError(event, line)
+}
+
+// xmrStakOutputParser parses xmr-stak output
+type xmrStakOutputParser struct{}
+
+var (
+	xmrStakAccepted = regexp.MustCompile(
+		`Result accepted by the pool`)
+	xmrStakRejected = regexp.MustCompile(
+		`Result rejected by the pool\.?(?::? (.*))?$`)
+	xmrStakDifficulty = regexp.MustCompile(
+		`Difficulty changed\. Now: (\d+)`)
+	xmrStakNewBlock = regexp.MustCompile(
+		`New block detected`)
+	xmrStakConnected = regexp.MustCompile(
+		`Pool (\S+) connected`)
+	xmrStakDisconnected = regexp.MustCompile(
+		`(?i)(pool connection lost|SOCKET ERROR[^:]*|CONNECT error|Pool logged in failed)[:.]?\s*(.*)$`)
+	xmrStakHugePages = regexp.MustCompile(
+		`MEMORY (?:ALLOC FAILED|INIT ERROR): (.*)$`)
+	xmrStakConfigError = regexp.MustCompile(
+		`(?i)(PARSE ERROR|Wrong config file|Invalid config|config file .* does not exist)`)
+)
+
+// Parse returns the event for the xmr-stak output line
+func (parser *xmrStakOutputParser) Parse(line string) (OutputEvent, bool) {
+	event := OutputEvent{
+		Line:             line,
+		HugePagesPercent: -1,
+	}
+
+	if xmrStakAccepted.MatchString(line) {
+		event.Type = EventShareAccepted
+		event.Severity = SeverityInfo
+		return event, true
+	}
+	if match := xmrStakRejected.FindStringSubmatch(line); match != nil {
+		event.Type = EventShareRejected
+		event.Severity = SeverityWarning
+		event.Reason = match[1]
+		return event, true
+	}
+	if match := xmrStakDifficulty.FindStringSubmatch(line); match != nil {
+		event.Type = EventNewJob
+		event.Severity = SeverityInfo
+		event.Difficulty = parseUint(match[1])
+		return event, true
+	}
+	if xmrStakNewBlock.MatchString(line) {
+		event.Type = EventNewJob
+		event.Severity = SeverityInfo
+		return event, true
+	}
+	if match := xmrStakConnected.FindStringSubmatch(line); match != nil {
+		event.Type = EventPoolConnected
+		event.Severity = SeverityInfo
+		event.Pool = match[1]
+		return event, true
+	}
+	if match := xmrStakDisconnected.FindStringSubmatch(line); match != nil {
+		event.Type = EventPoolDisconnected
+		event.Severity = SeverityWarning
+		event.Reason = strings.TrimSpace(match[1] + " " + match[2])
+		return event, true
+	}
+	if match := xmrStakHugePages.FindStringSubmatch(line); match != nil {
+		event.Type = EventHugePages
+		event.Severity = SeverityWarning
+		event.HugePagesEnabled = false
+		event.Reason = "Huge pages are not available, the hashrate will be lower: " + match[1]
+		return event, true
+	}
+	if xmrStakConfigError.MatchString(line) {
+		event.Type = EventConfigError
+		event.Severity = SeverityFatal
+		event.Reason = line
+		return event, true
+	}
+	return parseGenericError(event, line)
+}
+
+// keywordOutputParser reports lines containing any of the keywords as
+// errors. It is used for miners without a dedicated parser
+type keywordOutputParser struct {
+	keywords []string
+}
+
+// Parse returns an error event if the line contains any of the keywords
+func (parser *keywordOutputParser) Parse(line string) (OutputEvent, bool) {
+	lowerLine := strings.ToLower(line)
+	for _, keyword := range parser.keywords {
+		if strings.Contains(lowerLine, strings.ToLower(keyword)) {
+			return OutputEvent{
+				Type:             EventError,
+				Severity:         SeverityError,
+				Line:             line,
+				Reason:           line,
+				HugePagesPercent: -1,
+			}, true
+		}
+	}
+	return OutputEvent{}, false
+}
+
+// parseGenericError is the fallback for lines that don't match a specific
+// event. Lines mentioning an error are still reported
+func parseGenericError(event OutputEvent, line string) (OutputEvent, bool) {
+	lowerLine := strings.ToLower(line)
+	if strings.Contains(lowerLine, "error") || strings.Contains(lowerLine, "failed") {
+		event.Type = EventError
+		event.Severity = SeverityError
+		event.Reason = line
+		return event, true
+	}
+	return event, false
+}
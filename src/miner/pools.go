@@ -0,0 +1,83 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mininghq/rpcproto/rpcproto"
+)
+
+// poolConfigs returns the pools for the config in order of preference,
+// the first pool is the primary and the rest are failover pools
+//
+// Older assignments only set the single PoolConfig, it is used when
+// no PoolConfigs are given
+func poolConfigs(config rpcproto.MinerConfig) ([]*rpcproto.PoolConfig, error) {
+	var pools []*rpcproto.PoolConfig
+	for _, pool := range config.PoolConfigs {
+		if pool != nil {
+			pools = append(pools, pool)
+		}
+	}
+	if len(pools) == 0 && config.PoolConfig != nil {
+		pools = append(pools, config.PoolConfig)
+	}
+	if len(pools) == 0 {
+		return nil, errors.New("You must provide at least one PoolConfig")
+	}
+	for _, pool := range pools {
+		err := validatePoolEndpoint(pool.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pools, nil
+}
+
+// validatePoolEndpoint checks the pool endpoint is a host and port with
+// an optional scheme, ex. 'stratum+tcp://pool.example.com:3333'
+func validatePoolEndpoint(endpoint string) error {
+	if strings.TrimSpace(endpoint) == "" {
+		return errors.New("The pool endpoint must not be blank")
+	}
+	address := endpoint
+	if index := strings.Index(address, "://"); index != -1 {
+		address = address[index+3:]
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("Invalid pool endpoint '%s': %s", endpoint, err)
+	}
+	if strings.TrimSpace(host) == "" {
+		return fmt.Errorf("Invalid pool endpoint '%s': missing host", endpoint)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return fmt.Errorf("Invalid pool endpoint '%s': invalid port", endpoint)
+	}
+	return nil
+}
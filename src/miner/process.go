@@ -0,0 +1,340 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	unattended "github.com/ProjectLimitless/go-unattended"
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/sirupsen/logrus"
+)
+
+// minerProcess runs a miner binary installed by Unattended. We run the
+// process ourselves instead of through Unattended to be able to signal
+// it and read its exit status
+type minerProcess struct {
+	updateWrapper   *unattended.Unattended
+	withUpdate      bool
+	versionsPath    string
+	applicationName string
+	parameters      []string
+	log             *logrus.Entry
+	// prepare is called before every start of the miner, if set
+	prepare func() error
+
+	// mutex protects the fields below
+	mutex sync.Mutex
+	// cmd is the running process, nil if not running
+	cmd *exec.Cmd
+	// exited is closed once the running process exited
+	exited chan struct{}
+	// startedAt is when the running process was started
+	startedAt time.Time
+	// stopping is set when we requested the process to stop, it is
+	// never cleared. A stopped miner is replaced by a new instance
+	stopping bool
+	// restarting is set when an update requires the process to restart
+	restarting bool
+}
+
+// newMinerProcess creates a new process for the Unattended target
+func newMinerProcess(
+	updateWrapper *unattended.Unattended,
+	withUpdate bool,
+	target unattended.Target,
+	log *logrus.Entry) *minerProcess {
+	return &minerProcess{
+		updateWrapper:   updateWrapper,
+		withUpdate:      withUpdate,
+		versionsPath:    target.VersionsPath,
+		applicationName: target.ApplicationName,
+		parameters:      target.ApplicationParameters,
+		log:             log,
+	}
+}
+
+// run starts the miner and blocks until it exits. If updates are enabled
+// they are applied before starting and checked periodically while running,
+// the miner is restarted when an update was applied
+func (process *minerProcess) run(output io.WriteCloser) error {
+	defer output.Close()
+
+	for {
+		// Stop removes the config files, a stopped miner must not
+		// prepare its config or start again
+		if process.isStopping() {
+			return nil
+		}
+
+		if process.withUpdate {
+			//Check for and apply updates first
+			_, err := process.updateWrapper.ApplyUpdates()
+			if err != nil {
+				process.log.Warningf("Unable to apply updates: %s", err)
+			}
+		}
+
+		if process.prepare != nil {
+			err := process.prepare()
+			if err != nil {
+				return err
+			}
+		}
+
+		binaryPath, err := process.binaryPath()
+		if err != nil {
+			return err
+		}
+
+		cmd := exec.Command(binaryPath, process.parameters...)
+		cmd.Dir = filepath.Dir(binaryPath)
+		cmd.Stdout = output
+		cmd.Stderr = output
+
+		process.mutex.Lock()
+		if process.stopping {
+			process.mutex.Unlock()
+			return nil
+		}
+		err = cmd.Start()
+		if err != nil {
+			process.mutex.Unlock()
+			return err
+		}
+		process.cmd = cmd
+		process.exited = make(chan struct{})
+		process.startedAt = time.Now()
+		process.restarting = false
+		process.mutex.Unlock()
+
+		stopUpdates := make(chan struct{})
+		if process.withUpdate {
+			go process.watchUpdates(stopUpdates)
+		}
+
+		err = cmd.Wait()
+		close(stopUpdates)
+
+		process.mutex.Lock()
+		close(process.exited)
+		process.cmd = nil
+		stopping := process.stopping
+		restarting := process.restarting
+		process.mutex.Unlock()
+
+		if stopping {
+			return nil
+		}
+		if restarting {
+			process.log.Info("Restarting miner after update")
+			continue
+		}
+		if err == nil {
+			// The miner should never exit by itself
+			return errors.New("miner exited")
+		}
+		return err
+	}
+}
+
+// watchUpdates checks for updates until stopped and restarts the
+// miner if an update was applied
+func (process *minerProcess) watchUpdates(stop chan struct{}) {
+	ticker := time.NewTicker(conf.MinerUpdateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			updated, err := process.update()
+			if err != nil {
+				process.log.Warningf("Unable to apply updates: %s", err)
+				continue
+			}
+			if updated {
+				return
+			}
+		}
+	}
+}
+
+// applyUpdate applies a new version of the miner if available, the
+// running process is restarted if it was updated
+func (process *minerProcess) applyUpdate() error {
+	updated, err := process.update()
+	if err != nil {
+		return err
+	}
+	if updated {
+		process.log.WithField(
+			"version", process.updateWrapper.GetLatestVersion(),
+		).Info("Miner updated")
+	}
+	return nil
+}
+
+// update applies a new version of the miner if available and restarts the
+// running process to use it. It returns true if an update was applied
+func (process *minerProcess) update() (bool, error) {
+	version := process.updateWrapper.GetLatestVersion()
+	_, err := process.updateWrapper.ApplyUpdates()
+	if err != nil {
+		return false, err
+	}
+	if process.updateWrapper.GetLatestVersion() == version {
+		return false, nil
+	}
+
+	process.mutex.Lock()
+	cmd := process.cmd
+	exited := process.exited
+	if cmd != nil {
+		process.restarting = true
+	}
+	process.mutex.Unlock()
+	if cmd != nil {
+		err = terminate(cmd, exited, conf.MinerStopTimeout)
+		if err != nil {
+			return true, fmt.Errorf("unable to stop miner for update: %s", err)
+		}
+	}
+	return true, nil
+}
+
+// stop the running process gracefully, see terminate
+func (process *minerProcess) stop(timeout time.Duration) error {
+	process.mutex.Lock()
+	process.stopping = true
+	cmd := process.cmd
+	exited := process.exited
+	process.mutex.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+	return terminate(cmd, exited, timeout)
+}
+
+// isStopping returns true once stop was called
+func (process *minerProcess) isStopping() bool {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+	return process.stopping
+}
+
+// pid returns the process ID of the running miner, 0 if not running
+func (process *minerProcess) pid() int {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+	if process.cmd == nil || process.cmd.Process == nil {
+		return 0
+	}
+	return process.cmd.Process.Pid
+}
+
+// health returns the state of the process, the paths are the config
+// files the process needs
+func (process *minerProcess) health(configPaths ...string) Health {
+	pid := process.pid()
+	health := Health{
+		Running: pid != 0,
+		Uptime:  process.uptime(),
+		PID:     pid,
+	}
+	for _, configPath := range configPaths {
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			health.ConfigMissing = true
+		}
+	}
+	return health
+}
+
+// uptime returns how long the miner has been running, 0 if not running
+func (process *minerProcess) uptime() time.Duration {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+	if process.cmd == nil {
+		return 0
+	}
+	return time.Since(process.startedAt)
+}
+
+// binaryPath returns the path to the latest installed version of the miner
+func (process *minerProcess) binaryPath() (string, error) {
+	name := process.applicationName
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	version := process.updateWrapper.GetLatestVersion()
+	for _, versionDir := range []string{version, "v" + version} {
+		path := filepath.Join(process.versionsPath, versionDir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf(
+		"unable to find %s version %s in %s",
+		process.applicationName,
+		version,
+		process.versionsPath)
+}
+
+// terminate sends SIGTERM to the process and waits for it to exit. If it
+// doesn't exit within the timeout it is killed. Windows doesn't support
+// SIGTERM, the process is killed immediately
+func terminate(cmd *exec.Cmd, exited chan struct{}, timeout time.Duration) error {
+	err := cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		return cmd.Process.Kill()
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+		return cmd.Process.Kill()
+	}
+}
+
+// exitStatus returns the exit code and the signal (if any) that
+// terminated the process from the error returned by Start
+func exitStatus(err error) (int, string) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1, ""
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return -1, status.Signal().String()
+	}
+	return exitErr.ExitCode(), ""
+}
@@ -0,0 +1,145 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mininghq/rpcproto/rpcproto"
+)
+
+// Constructor creates a new, configured instance of a miner
+//
+// It takes whether the miner should check for updates, the unattended base
+// path, the path to use for the config and the configuration to use
+type Constructor func(
+	withUpdate bool,
+	basePath string,
+	configPath string,
+	config rpcproto.MinerConfig) (Miner, error)
+
+// Validator checks a configuration before a miner is created for it, it
+// must not have any side effects
+type Validator func(config rpcproto.MinerConfig) error
+
+var (
+	// registryMutex protects the registry and validators
+	registryMutex sync.RWMutex
+	// registry holds the constructors for each miner type
+	registry = make(map[string]Constructor)
+	// validators holds the optional validators for each miner type
+	validators = make(map[string]Validator)
+)
+
+// Register makes a miner implementation available under the given type.
+// The type must match the miner type sent by MiningHQ in the assignment
+func Register(minerType string, constructor Constructor) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if constructor == nil {
+		panic("miner: Register constructor is nil for " + minerType)
+	}
+	if _, exists := registry[minerType]; exists {
+		panic("miner: Register called twice for " + minerType)
+	}
+	registry[minerType] = constructor
+}
+
+// RegisterValidator sets the validator for the configs of a miner type
+func RegisterValidator(minerType string, validator Validator) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if validator == nil {
+		panic("miner: RegisterValidator validator is nil for " + minerType)
+	}
+	validators[minerType] = validator
+}
+
+// Validate checks that a miner of the given type can be created for the
+// config without creating it
+func Validate(minerType string, config rpcproto.MinerConfig) error {
+	registryMutex.RLock()
+	_, exists := registry[minerType]
+	validator := validators[minerType]
+	registryMutex.RUnlock()
+	if !exists {
+		return fmt.Errorf(
+			"Unknown miner type '%s', supported types are %v", minerType, Types())
+	}
+
+	if strings.TrimSpace(config.Key) == "" {
+		return errors.New("The miner key must not be blank")
+	}
+	_, err := poolConfigs(config)
+	if err != nil {
+		return err
+	}
+	if validator != nil {
+		return validator(config)
+	}
+	return nil
+}
+
+// IsRegistered returns true if a miner implementation exists for the type
+func IsRegistered(minerType string) bool {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	_, exists := registry[minerType]
+	return exists
+}
+
+// Types returns the sorted list of registered miner types
+func Types() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	var types []string
+	for minerType := range registry {
+		types = append(types, minerType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New creates a new miner of the given type using its registered constructor
+func New(
+	minerType string,
+	withUpdate bool,
+	basePath string,
+	configPath string,
+	config rpcproto.MinerConfig) (Miner, error) {
+
+	registryMutex.RLock()
+	constructor, exists := registry[minerType]
+	registryMutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf(
+			"Unknown miner type '%s', supported types are %v", minerType, Types())
+	}
+	return constructor(withUpdate, basePath, configPath, config)
+}
@@ -0,0 +1,352 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/sirupsen/logrus"
+)
+
+// statsClient is shared by all the miners to read their local APIs. It
+// reuses connections since the stats are collected periodically
+var statsClient = &http.Client{
+	Timeout: conf.MinerStatsTimeout,
+	Transport: &http.Transport{
+		// The miner APIs are local, never use a proxy
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout:   conf.MinerStatsTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        20,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// getStatsJSON requests the URL from the miner API and decodes the JSON
+// response. The token is sent as a bearer token if not blank
+//
+// Miners only populate some fields once they are up and running, fields
+// with unexpected types are skipped instead of failing the whole response
+func getStatsJSON(url string, token string, response interface{}) error {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	httpResponse, err := statsClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	return decodeStatsJSON(url, httpResponse, response)
+}
+
+// getStatsJSONDigest requests the URL from a miner API that requires HTTP
+// digest authentication and decodes the JSON response
+func getStatsJSONDigest(
+	url string,
+	username string,
+	password string,
+	response interface{}) error {
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := statsClient.Do(request)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode == http.StatusUnauthorized {
+		challenge := httpResponse.Header.Get("WWW-Authenticate")
+		httpResponse.Body.Close()
+		authorization, err := digestAuthorization(
+			challenge,
+			request.Method,
+			request.URL.RequestURI(),
+			username,
+			password)
+		if err != nil {
+			return fmt.Errorf("miner API %s: %s", url, err)
+		}
+		request, err = http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		request.Header.Add("Authorization", authorization)
+		httpResponse, err = statsClient.Do(request)
+		if err != nil {
+			return err
+		}
+	}
+	defer httpResponse.Body.Close()
+	return decodeStatsJSON(url, httpResponse, response)
+}
+
+// decodeStatsJSON decodes the JSON stats from the miner API response
+func decodeStatsJSON(
+	url string,
+	httpResponse *http.Response,
+	response interface{}) error {
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("miner API %s returned %s", url, httpResponse.Status)
+	}
+
+	err := json.NewDecoder(httpResponse.Body).Decode(response)
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		// The rest of the response was decoded
+		logrus.WithField(
+			"url", url,
+		).Debugf("Skipped miner API field: %s", typeErr)
+		return nil
+	}
+	return err
+}
+
+// jsonRPCRequest is a JSON-RPC 2.0 request to a miner API
+type jsonRPCRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+}
+
+// jsonRPCResponse is the JSON-RPC 2.0 response from a miner API
+type jsonRPCResponse struct {
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// callJSONRPC calls the JSON-RPC method without parameters on the
+// miner API
+func callJSONRPC(url string, token string, method string) error {
+	requestBytes, err := json.Marshal(jsonRPCRequest{
+		JSONRPC: "2.0",
+		ID:      1,
+		Method:  method,
+	})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", url, bytes.NewReader(requestBytes))
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	httpResponse, err := statsClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("miner API %s returned %s", url, httpResponse.Status)
+	}
+
+	var response jsonRPCResponse
+	err = json.NewDecoder(httpResponse.Body).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return fmt.Errorf(
+			"miner API %s failed: %s (%d)",
+			method,
+			response.Error.Message,
+			response.Error.Code)
+	}
+	return nil
+}
+
+// putJSON sends the body as JSON to the miner API
+func putJSON(url string, token string, body interface{}) error {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("PUT", url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	httpResponse, err := statsClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK &&
+		httpResponse.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("miner API %s returned %s", url, httpResponse.Status)
+	}
+	return nil
+}
+
+// digestAuthorization returns the Authorization header answering the
+// HTTP digest challenge, only MD5 is supported
+func digestAuthorization(
+	challenge string,
+	method string,
+	uri string,
+	username string,
+	password string) (string, error) {
+
+	if !strings.HasPrefix(challenge, "Digest ") {
+		return "", fmt.Errorf("unsupported authentication challenge '%s'", challenge)
+	}
+	params := parseDigestChallenge(strings.TrimPrefix(challenge, "Digest "))
+	algorithm := params["algorithm"]
+	if algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return "", fmt.Errorf("unsupported digest algorithm '%s'", algorithm)
+	}
+
+	md5Hex := func(value string) string {
+		sum := md5.Sum([]byte(value))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", username, params["realm"], password))
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, uri))
+
+	authorization := fmt.Sprintf(
+		`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		username,
+		params["realm"],
+		params["nonce"],
+		uri)
+	qopAuth := false
+	for _, qop := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(qop) == "auth" {
+			qopAuth = true
+		}
+	}
+	if qopAuth {
+		cnonceBytes := make([]byte, 8)
+		_, err := rand.Read(cnonceBytes)
+		if err != nil {
+			return "", err
+		}
+		cnonce := hex.EncodeToString(cnonceBytes)
+		nonceCount := "00000001"
+		authorization += fmt.Sprintf(
+			`, qop=auth, nc=%s, cnonce="%s", response="%s"`,
+			nonceCount,
+			cnonce,
+			md5Hex(fmt.Sprintf("%s:%s:%s:%s:auth:%s", ha1, params["nonce"], nonceCount, cnonce, ha2)))
+	} else {
+		authorization += fmt.Sprintf(
+			`, response="%s"`,
+			md5Hex(fmt.Sprintf("%s:%s:%s", ha1, params["nonce"], ha2)))
+	}
+	if opaque, ok := params["opaque"]; ok {
+		authorization += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return authorization, nil
+}
+
+// parseDigestChallenge parses the comma separated key=value parameters of
+// a digest challenge, quoted values may contain commas
+func parseDigestChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	for len(challenge) > 0 {
+		challenge = strings.TrimLeft(challenge, " ,")
+		separator := strings.Index(challenge, "=")
+		if separator < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(challenge[:separator]))
+		challenge = challenge[separator+1:]
+
+		var value string
+		if strings.HasPrefix(challenge, `"`) {
+			end := strings.Index(challenge[1:], `"`)
+			if end < 0 {
+				value = challenge[1:]
+				challenge = ""
+			} else {
+				value = challenge[1 : end+1]
+				challenge = challenge[end+2:]
+			}
+		} else {
+			end := strings.Index(challenge, ",")
+			if end < 0 {
+				end = len(challenge)
+			}
+			value = strings.TrimSpace(challenge[:end])
+			challenge = challenge[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// generateAccessToken creates a random token for a miner's API
+func generateAccessToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+// errorLogMessages returns the readable messages from a miner API error
+// log. Entries are either plain strings or objects with a 'text' field
+func errorLogMessages(errorLog []interface{}) []string {
+	var messages []string
+	for _, entry := range errorLog {
+		switch typed := entry.(type) {
+		case string:
+			messages = append(messages, typed)
+		case map[string]interface{}:
+			if text, ok := typed["text"].(string); ok {
+				messages = append(messages, text)
+			}
+		}
+	}
+	return messages
+}
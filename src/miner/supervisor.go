@@ -0,0 +1,324 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mininghq/miner-controller/src/conf"
+	"github.com/mininghq/rpcproto/rpcproto"
+)
+
+// CrashReport describes an unexpected exit of a miner
+type CrashReport struct {
+	// Err is the error returned when the miner exited
+	Err error
+	// ExitCode of the miner process, -1 if unknown or killed by a signal
+	ExitCode int
+	// Signal that killed the miner process, blank if none
+	Signal string
+	// LastLogs are the last lines the miner printed before exiting
+	LastLogs []string
+	// Crashes is the number of crashes within conf.MinerCrashLoopWindow
+	Crashes int
+	// CrashLoop is set when the miner crashed too often and will not
+	// be restarted again
+	CrashLoop bool
+	// RestartIn is the time until the miner is restarted
+	RestartIn time.Duration
+}
+
+// String returns the human readable crash description
+func (report CrashReport) String() string {
+	exit := fmt.Sprintf("exit code %d", report.ExitCode)
+	if report.Signal != "" {
+		exit = fmt.Sprintf("signal %s", report.Signal)
+	}
+	summary := fmt.Sprintf("Miner exited unexpectedly (%s): %v", exit, report.Err)
+	if report.CrashLoop {
+		summary = fmt.Sprintf(
+			"Miner crash loop detected, exited %d times in %s, not restarting. Last error (%s): %v",
+			report.Crashes,
+			conf.MinerCrashLoopWindow,
+			exit,
+			report.Err)
+	}
+	if len(report.LastLogs) == 0 {
+		return summary
+	}
+	return fmt.Sprintf("%s\n%s", summary, strings.Join(report.LastLogs, "\n"))
+}
+
+// Supervisor wraps a Miner and restarts it with exponential backoff when
+// it exits unexpectedly. When the miner crashes too often in a short time
+// it is considered a crash loop and the supervisor gives up
+type Supervisor struct {
+	// Miner is the supervised miner, all calls except Start and Stop
+	// are passed through
+	Miner
+	// crashHandler is called for every crash
+	crashHandler func(string, CrashReport)
+
+	// mutex protects the fields below
+	mutex sync.Mutex
+	// stopped is set once Stop was called
+	stopped bool
+	// supervising is set while Start keeps the miner running
+	supervising bool
+	// gaveUpAt is when Start returned because of a crash loop
+	gaveUpAt time.Time
+	// stopChannel is closed when Stop is called to interrupt the backoff
+	stopChannel chan struct{}
+	// crashes holds the times of the recent crashes
+	crashes []time.Time
+	// firstExit receives the error of the first unexpected exit
+	firstExit chan error
+}
+
+// NewSupervisor creates a new supervisor for the miner
+func NewSupervisor(miner Miner) *Supervisor {
+	return &Supervisor{
+		Miner:       miner,
+		stopChannel: make(chan struct{}),
+		firstExit:   make(chan error, 1),
+	}
+}
+
+// SetCrashHandler sets the handler to report crashes to
+// It takes the miner key and the crash report
+func (supervisor *Supervisor) SetCrashHandler(crashHandler func(string, CrashReport)) {
+	supervisor.crashHandler = crashHandler
+}
+
+// Start the miner and keep it running until Stop is called. It only returns
+// an error when a crash loop was detected
+func (supervisor *Supervisor) Start() error {
+	supervisor.mutex.Lock()
+	if supervisor.stopped {
+		supervisor.mutex.Unlock()
+		return nil
+	}
+	stopChannel := supervisor.stopChannel
+	supervisor.supervising = true
+	supervisor.mutex.Unlock()
+	defer func() {
+		supervisor.mutex.Lock()
+		supervisor.supervising = false
+		supervisor.mutex.Unlock()
+	}()
+
+	backoff := conf.MinerRestartMinBackoff
+	for {
+		startedAt := time.Now()
+		err := supervisor.Miner.Start()
+		if supervisor.isStopped() {
+			return nil
+		}
+
+		// A miner that ran for a while before crashing is not
+		// failing to start, restart quickly
+		if time.Since(startedAt) >= conf.MinerStableRuntime {
+			backoff = conf.MinerRestartMinBackoff
+		}
+
+		supervisor.reportExit(err)
+
+		report := supervisor.newCrashReport(err, backoff)
+		if supervisor.crashHandler != nil {
+			supervisor.crashHandler(supervisor.GetKey(), report)
+		}
+		if report.CrashLoop {
+			supervisor.mutex.Lock()
+			supervisor.gaveUpAt = time.Now()
+			supervisor.mutex.Unlock()
+			return errors.New(report.String())
+		}
+
+		select {
+		case <-stopChannel:
+			return nil
+		case <-time.After(backoff):
+		}
+		// Stop may have been called as the backoff ended, the miner
+		// must not be started again
+		if supervisor.isStopped() {
+			return nil
+		}
+
+		backoff *= 2
+		if backoff > conf.MinerRestartMaxBackoff {
+			backoff = conf.MinerRestartMaxBackoff
+		}
+	}
+}
+
+// Pause the supervised miner if it supports pausing
+func (supervisor *Supervisor) Pause() error {
+	pauser, ok := supervisor.Miner.(Pauser)
+	if !ok {
+		return ErrNotSupported
+	}
+	return pauser.Pause()
+}
+
+// Resume the supervised miner if it supports pausing
+func (supervisor *Supervisor) Resume() error {
+	pauser, ok := supervisor.Miner.(Pauser)
+	if !ok {
+		return ErrNotSupported
+	}
+	return pauser.Resume()
+}
+
+// Reconfigure the supervised miner if it supports it
+func (supervisor *Supervisor) Reconfigure(config rpcproto.MinerConfig) error {
+	reconfigurer, ok := supervisor.Miner.(Reconfigurer)
+	if !ok {
+		return ErrNotSupported
+	}
+	return reconfigurer.Reconfigure(config)
+}
+
+// SetLogBufferSize sets the log buffer size of the supervised miner if
+// it supports it
+func (supervisor *Supervisor) SetLogBufferSize(lines int) {
+	if sizer, ok := supervisor.Miner.(LogBufferSizer); ok {
+		sizer.SetLogBufferSize(lines)
+	}
+}
+
+// SetLogHandler sets the log handler of the supervised miner if it
+// supports it
+func (supervisor *Supervisor) SetLogHandler(logHandler func(string, string)) {
+	if tailer, ok := supervisor.Miner.(LogTailer); ok {
+		tailer.SetLogHandler(logHandler)
+	}
+}
+
+// Health returns the actual state of the supervised miner
+func (supervisor *Supervisor) Health() Health {
+	var health Health
+	if checker, ok := supervisor.Miner.(HealthChecker); ok {
+		health = checker.Health()
+	}
+	supervisor.mutex.Lock()
+	health.Supervised = supervisor.supervising
+	health.GaveUpAt = supervisor.gaveUpAt
+	health.Stopped = supervisor.stopped
+	supervisor.mutex.Unlock()
+	return health
+}
+
+// WaitStarted waits for the miner to keep running for the timeout after
+// Start was called. It returns the error if the miner exited before
+func (supervisor *Supervisor) WaitStarted(timeout time.Duration) error {
+	if timeout < 0 {
+		timeout = 0
+	}
+	select {
+	case err := <-supervisor.firstExit:
+		// Keep it for the next call
+		supervisor.reportExit(err)
+		return err
+	case <-supervisor.stopChannel:
+		return errors.New("miner was stopped")
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// Stop the miner, it will not be restarted
+func (supervisor *Supervisor) Stop() error {
+	supervisor.mutex.Lock()
+	if !supervisor.stopped {
+		supervisor.stopped = true
+		close(supervisor.stopChannel)
+	}
+	supervisor.mutex.Unlock()
+	return supervisor.Miner.Stop()
+}
+
+// Update the supervised miner if it supports updates
+func (supervisor *Supervisor) Update() error {
+	updater, ok := supervisor.Miner.(Updater)
+	if !ok {
+		return ErrNotSupported
+	}
+	return updater.Update()
+}
+
+// reportExit records the exit for WaitStarted, only the first exit
+// is kept
+func (supervisor *Supervisor) reportExit(err error) {
+	if err == nil {
+		err = errors.New("miner exited")
+	}
+	select {
+	case supervisor.firstExit <- err:
+	default:
+	}
+}
+
+// isStopped returns true once Stop was called
+func (supervisor *Supervisor) isStopped() bool {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	return supervisor.stopped
+}
+
+// newCrashReport records the crash and creates the report for it
+func (supervisor *Supervisor) newCrashReport(
+	err error,
+	backoff time.Duration) CrashReport {
+
+	supervisor.mutex.Lock()
+	now := time.Now()
+	var recentCrashes []time.Time
+	for _, crashedAt := range supervisor.crashes {
+		if now.Sub(crashedAt) < conf.MinerCrashLoopWindow {
+			recentCrashes = append(recentCrashes, crashedAt)
+		}
+	}
+	supervisor.crashes = append(recentCrashes, now)
+	crashes := len(supervisor.crashes)
+	supervisor.mutex.Unlock()
+
+	exitCode, signal := exitStatus(err)
+	logs := supervisor.GetLogs()
+	if len(logs) > conf.MinerCrashLogLines {
+		logs = logs[len(logs)-conf.MinerCrashLogLines:]
+	}
+
+	return CrashReport{
+		Err:       err,
+		ExitCode:  exitCode,
+		Signal:    signal,
+		LastLogs:  logs,
+		Crashes:   crashes,
+		CrashLoop: crashes >= conf.MinerCrashLoopCount,
+		RestartIn: backoff,
+	}
+}
@@ -22,15 +22,12 @@
 package miner
 
 import (
-	"bufio"
-	"container/list"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -49,13 +46,25 @@ type Xmrig struct {
 	configPath    string
 	withUpdate    bool
 	updateWrapper *unattended.Unattended
-	errorHandler  func(string, string)
-
-	key      string
-	apiPort  int
-	logList  *list.List
-	logMax   int
-	logMutex sync.Mutex
+	process       *minerProcess
+	*minerOutput
+
+	// configMutex protects config, schemaVersion and apiPort, they are
+	// written by the process goroutine before every start
+	configMutex sync.Mutex
+	// config is the current assignment config, it is used to rewrite the
+	// config when an update changes the schema
+	config rpcproto.MinerConfig
+	// schemaVersion is the major xmrig version the config was written for
+	schemaVersion int
+	apiPort       int
+
+	key string
+	// accessToken is required by the miner API
+	accessToken string
+	// paused is set while mining is paused through the API
+	paused      bool
+	pausedMutex sync.Mutex
 }
 
 type xmrigPool struct {
@@ -73,9 +82,10 @@ type xmrigPool struct {
 // cpuConfigSpec contains the options to write to the xmrig JSON config
 type xmrigCPUConfigSpec struct {
 	API struct {
-		Port       int  `json:"port"`
-		Ipv6       bool `json:"ipv6"`
-		Restricted bool `json:"restricted"`
+		Port        int    `json:"port"`
+		AccessToken string `json:"access-token"`
+		Ipv6        bool   `json:"ipv6"`
+		Restricted  bool   `json:"restricted"`
 	} `json:"api"`
 	Asm         string      `json:"asm"`
 	Autosave    bool        `json:"autosave"`
@@ -124,7 +134,7 @@ type xmrigAPIResponse struct {
 		SharesTotal uint32        `json:"shares_total"`
 		AvgTime     int           `json:"avg_time"`
 		HashesTotal uint64        `json:"hashes_total"`
-		Best        []int         `json:"best"`
+		Best        []uint64      `json:"best"`
 		ErrorLog    []interface{} `json:"error_log"`
 	} `json:"results"`
 	Connection struct {
@@ -136,6 +146,22 @@ type xmrigAPIResponse struct {
 	} `json:"connection"`
 }
 
+func init() {
+	Register("xmrig", func(
+		withUpdate bool,
+		basePath string,
+		configPath string,
+		config rpcproto.MinerConfig) (Miner, error) {
+		miner, err := NewXmrig(withUpdate, basePath, configPath, config)
+		if miner == nil {
+			// Avoid returning a typed nil as a Miner
+			return nil, err
+		}
+		return miner, err
+	})
+	RegisterValidator("xmrig", validateXmrigConfig)
+}
+
 // NewXmrig creates a new instance of the xmrig CPU miner
 //
 // It takes the unattended base path, the path to use for the config
@@ -148,69 +174,109 @@ func NewXmrig(
 	configPath string,
 	config rpcproto.MinerConfig) (*Xmrig, error) {
 
-	// Setup the logging, by default we log to stdout
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp:   true,
-		TimestampFormat: "Jan 02 15:04:05",
-	})
-	logrus.SetLevel(logrus.InfoLevel)
-	// TODO: Debug?
-	logrus.SetLevel(logrus.DebugLevel)
-
-	logrus.SetOutput(os.Stdout)
-
 	log := logrus.WithFields(logrus.Fields{
 		"service": "unattended",
 	})
 	log.Info("Setting up Unattended updates")
 
-	xmrig := Xmrig{
-		key:        config.Key,
-		withUpdate: withUpdate,
-		configPath: configPath,
-		logList:    list.New(),
-		logMax:     100,
-	}
-	err := xmrig.configure(config)
+	accessToken, err := generateAccessToken()
 	if err != nil {
-		log.Errorf("Unable to configure miner: %s", err.Error())
-		return nil, err
+		return nil, fmt.Errorf("Unable to generate API access token: %s", err)
 	}
 
+	xmrig := Xmrig{
+		accessToken: accessToken,
+		key:         config.Key,
+		withUpdate:  withUpdate,
+		configPath:  configPath,
+		minerOutput: newMinerOutput(config.Key, &xmrigOutputParser{}),
+	}
+	target := unattended.Target{
+		VersionsPath:    basePath,
+		AppID:           fmt.Sprintf("xmrig-%s", strings.ToLower(runtime.GOOS)),
+		UpdateEndpoint:  conf.UnattendedBaseURL,
+		UpdateChannel:   "stable",
+		ApplicationName: "xmrig",
+		ApplicationParameters: []string{
+			"--config",
+			configPath,
+		},
+	}
 	xmrig.updateWrapper, err = unattended.New(
 		"TEST001", // TODO clientID - miner key?
-		unattended.Target{ // target
-			VersionsPath:    basePath,
-			AppID:           fmt.Sprintf("xmrig-%s", strings.ToLower(runtime.GOOS)),
-			UpdateEndpoint:  conf.UnattendedBaseURL,
-			UpdateChannel:   "stable",
-			ApplicationName: "xmrig",
-			ApplicationParameters: []string{
-				"--config",
-				configPath,
-			},
-		},
+		target,
 		time.Hour, // UpdateCheckInterval
 		log,
 	)
 	if err != nil {
 		return nil, err
 	}
+	xmrig.process = newMinerProcess(xmrig.updateWrapper, withUpdate, target, log)
+	// Updates may change the config schema, check before every start
+	xmrig.process.prepare = xmrig.prepareConfig
+
+	var updateErr error
 	if xmrig.withUpdate {
 		// During construction we check for any updates as well, this has the
 		// side effect that *if* the miner doesn't exist yet, it will be downloaded
-		_, err = xmrig.updateWrapper.ApplyUpdates()
+		_, updateErr = xmrig.updateWrapper.ApplyUpdates()
 	}
-	return &xmrig, err
+
+	// The config schema depends on the installed version, so we can
+	// only configure once the miner is downloaded
+	err = xmrig.configure(config)
+	if err != nil {
+		log.Errorf("Unable to configure miner: %s", err.Error())
+		return nil, err
+	}
+	return &xmrig, updateErr
+}
+
+// xmrigAlgorithmFamilies are the algorithm families supported by xmrig
+var xmrigAlgorithmFamilies = map[string]bool{
+	"cn":         true,
+	"cn-lite":    true,
+	"cn-heavy":   true,
+	"cn-pico":    true,
+	"cn-femto":   true,
+	"rx":         true,
+	"argon2":     true,
+	"astrobwt":   true,
+	"kawpow":     true,
+	"ghostrider": true,
+}
+
+// validateXmrigConfig checks the config can be used with xmrig
+func validateXmrigConfig(config rpcproto.MinerConfig) error {
+	if config.CPUConfig == nil {
+		return fmt.Errorf("You must provide a CPUConfig for xmrig")
+	}
+	family := xmrigV5AlgorithmFamily(xmrigV5Algorithm(config.Algorithm, ""))
+	if !xmrigAlgorithmFamilies[family] {
+		return fmt.Errorf("Unknown algorithm '%s' for xmrig", config.Algorithm)
+	}
+	return nil
 }
 
 // configure xmrig via the config file. Once reconfigured, the miner
 // would need to be restarted
 func (miner *Xmrig) configure(config rpcproto.MinerConfig) error {
+	miner.configMutex.Lock()
+	defer miner.configMutex.Unlock()
+	return miner.configureLocked(config)
+}
+
+// configureLocked configures xmrig, the caller must hold configMutex
+func (miner *Xmrig) configureLocked(config rpcproto.MinerConfig) error {
 
 	if config.CPUConfig == nil {
 		return fmt.Errorf("You must provide a CPUConfig for xmrig")
 	}
+	miner.config = config
+	miner.schemaVersion = xmrigMajorVersion(miner.GetVersion())
+	if miner.schemaVersion >= 5 {
+		return miner.configureV5(config)
+	}
 
 	cpuConfig, err := miner.generateDefaultCPUConfig()
 	if err != nil {
@@ -218,13 +284,27 @@ func (miner *Xmrig) configure(config rpcproto.MinerConfig) error {
 	}
 	cpuConfig.Threads = int(config.CPUConfig.ThreadCount)
 	cpuConfig.Algo = config.Algorithm
-	cpuConfig.Pools = []xmrigPool{
-		{
-			URL:     config.PoolConfig.Endpoint,
-			User:    config.PoolConfig.Username,
-			Pass:    config.PoolConfig.Password,
-			Variant: config.PoolConfig.Variant,
-		},
+	// xmrig fails over to the next pool in the list
+	pools, err := poolConfigs(config)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		xmrigPool := xmrigPool{
+			URL:       pool.Endpoint,
+			User:      pool.Username,
+			Pass:      pool.Password,
+			RigID:     pool.RigID,
+			Nicehash:  pool.Nicehash,
+			Keepalive: pool.Keepalive,
+			Variant:   pool.Variant,
+			TLS:       pool.TLS,
+		}
+		// xmrig expects null when the fingerprint is not pinned
+		if pool.TLSFingerprint != "" {
+			xmrigPool.TLSFingerprint = pool.TLSFingerprint
+		}
+		cpuConfig.Pools = append(cpuConfig.Pools, xmrigPool)
 	}
 	return miner.writeConfig(cpuConfig)
 }
@@ -232,55 +312,73 @@ func (miner *Xmrig) configure(config rpcproto.MinerConfig) error {
 // Start xmrig
 func (miner *Xmrig) Start() error {
 
-	if miner.errorHandler == nil {
-		return errors.New("error handler is nil, it must be set using SetErrorHandler")
+	outputWriter, err := miner.readOutput()
+	if err != nil {
+		return err
+	}
+	return miner.process.run(outputWriter)
+}
+
+// Stop the miner and remove the config files
+func (miner *Xmrig) Stop() error {
+	err := miner.process.stop(conf.MinerStopTimeout)
+	if err != nil {
+		return err
 	}
+	return os.Remove(miner.configPath)
+}
 
-	// Setup the reading of the output
-	outputReader, outputWriter := io.Pipe()
-	miner.updateWrapper.SetOutputWriter(outputWriter)
-	//miner.updateWrapper.SetOutputWriter(os.Stdout)
-	go func() {
-		scanner := bufio.NewScanner(outputReader)
-		for scanner.Scan() {
-			miner.logMutex.Lock()
-			miner.logList.PushBack(scanner.Text())
-			if miner.logList.Len() >= miner.logMax {
-				miner.logList.Remove(miner.logList.Front())
-			}
-			miner.logMutex.Unlock()
-
-			// Check if we got any errors
-			// We do it by reading the logs because errors are not *always*
-			// available via an API
-			if strings.Contains(strings.ToLower(scanner.Text()), "error") ||
-				strings.Contains(strings.ToLower(scanner.Text()), "invalid") {
-				miner.errorHandler(miner.GetKey(), scanner.Text())
-			}
-		}
-	}()
+// Update installs a new version of xmrig if one is available
+func (miner *Xmrig) Update() error {
+	return miner.process.applyUpdate()
+}
 
-	if miner.withUpdate {
-		//Check for and apply updates first
-		miner.updateWrapper.ApplyUpdates()
-		return miner.updateWrapper.Run()
-	}
-	return miner.updateWrapper.RunWithoutUpdate()
+// Health returns the actual state of the miner
+func (miner *Xmrig) Health() Health {
+	health := miner.process.health(miner.configPath)
+	_, health.APIPort = miner.apiSettings()
+	miner.pausedMutex.Lock()
+	health.Paused = miner.paused
+	miner.pausedMutex.Unlock()
+	return health
 }
 
-// SetErrorHandler sets the handler to send any errors to
-// It takes the miner key and the string containing the error
-func (miner *Xmrig) SetErrorHandler(errorHandler func(string, string)) {
-	miner.errorHandler = errorHandler
+// Pause mining through the JSON-RPC API, the process keeps running. Only
+// xmrig 5+ supports it
+func (miner *Xmrig) Pause() error {
+	return miner.setPaused(true)
 }
 
-// Stop the miner and remove the config files
-func (miner *Xmrig) Stop() error {
-	err := miner.updateWrapper.Stop()
+// Resume mining through the JSON-RPC API after Pause
+func (miner *Xmrig) Resume() error {
+	return miner.setPaused(false)
+}
+
+// setPaused pauses or resumes mining through the JSON-RPC API
+func (miner *Xmrig) setPaused(paused bool) error {
+	schemaVersion, apiPort := miner.apiSettings()
+	if schemaVersion < 5 {
+		return ErrNotSupported
+	}
+	if miner.process.pid() == 0 {
+		return errors.New("miner is not running")
+	}
+
+	method := "resume"
+	if paused {
+		method = "pause"
+	}
+	err := callJSONRPC(
+		fmt.Sprintf("http://127.0.0.1:%d/json_rpc", apiPort),
+		miner.accessToken,
+		method)
 	if err != nil {
 		return err
 	}
-	return os.Remove(miner.configPath)
+	miner.pausedMutex.Lock()
+	miner.paused = paused
+	miner.pausedMutex.Unlock()
+	return nil
 }
 
 // GetType returns the miner type
@@ -296,26 +394,47 @@ func (miner *Xmrig) GetKey() string {
 // GetStats returns the mining stats in a uniform format from xmrig
 func (miner *Xmrig) GetStats() (rpcproto.MinerStats, error) {
 
-	var stats rpcproto.MinerStats
-
-	response, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d", miner.apiPort))
-	if err != nil {
-		return stats, err
+	schemaVersion, apiPort := miner.apiSettings()
+	if schemaVersion >= 5 {
+		return miner.getStatsV5(apiPort)
 	}
 
+	var stats rpcproto.MinerStats
+
 	var xmrigStats xmrigAPIResponse
-	err = json.NewDecoder(response.Body).Decode(&xmrigStats)
+	err := getStatsJSON(
+		fmt.Sprintf("http://127.0.0.1:%d", apiPort),
+		miner.accessToken,
+		&xmrigStats)
 	if err != nil {
 		return stats, err
 	}
 	stats.Key = miner.key
-	stats.Hashrate = xmrigStats.Hashrate.Total[0]
+	// The hashrate windows are empty right after starting
+	if len(xmrigStats.Hashrate.Total) > 0 {
+		stats.Hashrate = xmrigStats.Hashrate.Total[0]
+	}
+	if len(xmrigStats.Hashrate.Total) > 1 {
+		stats.Hashrate60S = xmrigStats.Hashrate.Total[1]
+	}
+	if len(xmrigStats.Hashrate.Total) > 2 {
+		stats.Hashrate15M = xmrigStats.Hashrate.Total[2]
+	}
 	stats.MaxHashrate = xmrigStats.Hashrate.Highest
 	stats.TotalHashes = xmrigStats.Results.HashesTotal
 	stats.CurrentDifficulty = xmrigStats.Results.DiffCurrent
 	stats.TotalShares = xmrigStats.Results.SharesTotal
 	stats.AcceptedShares = xmrigStats.Results.SharesGood
-	stats.RejectedShares = stats.TotalShares - stats.AcceptedShares
+	stats.AverageShareTime = uint32(xmrigStats.Results.AvgTime)
+	stats.BestShares = xmrigStats.Results.Best
+	stats.Pool = xmrigStats.Connection.Pool
+	stats.PoolPing = uint32(xmrigStats.Connection.Ping)
+	stats.PoolUptime = uint64(xmrigStats.Connection.Uptime)
+	stats.PoolFailures = uint32(xmrigStats.Connection.Failures)
+	stats.PoolErrors = errorLogMessages(xmrigStats.Connection.ErrorLog)
+	if stats.TotalShares >= stats.AcceptedShares {
+		stats.RejectedShares = stats.TotalShares - stats.AcceptedShares
+	}
 
 	cpuStats := rpcproto.CPUStats{}
 	for _, thread := range xmrigStats.Hashrate.Threads {
@@ -327,27 +446,48 @@ func (miner *Xmrig) GetStats() (rpcproto.MinerStats, error) {
 	return stats, nil
 }
 
-// GetLogs returns the last logs from the actual miner
-func (miner *Xmrig) GetLogs() []string {
-	// Get all the logs and return them in the current order
-	miner.logMutex.Lock()
-	defer miner.logMutex.Unlock()
+// GetVersion returns the latest version currently running
+func (miner *Xmrig) GetVersion() string {
+	return miner.updateWrapper.GetLatestVersion()
+}
 
-	var logs []string
-	for item := miner.logList.Front(); item != nil; item = item.Next() {
-		log := item.Value.(string)
-		logs = append(logs, log)
+// prepareConfig rewrites the config if the installed version needs
+// a different config schema than the one written. It is called before
+// every start of the process
+func (miner *Xmrig) prepareConfig() error {
+	// A restarted miner is no longer paused
+	miner.pausedMutex.Lock()
+	miner.paused = false
+	miner.pausedMutex.Unlock()
+
+	miner.configMutex.Lock()
+	defer miner.configMutex.Unlock()
+	if xmrigMajorVersion(miner.GetVersion()) >= 5 == (miner.schemaVersion >= 5) {
+		return nil
 	}
-	return logs
+	return miner.configureLocked(miner.config)
 }
 
-// GetVersion returns the latest version currently running
-func (miner *Xmrig) GetVersion() string {
-	return miner.updateWrapper.GetLatestVersion()
+// apiSettings returns the config schema version and the API port
+func (miner *Xmrig) apiSettings() (int, int) {
+	miner.configMutex.Lock()
+	defer miner.configMutex.Unlock()
+	return miner.schemaVersion, miner.apiPort
+}
+
+// xmrigMajorVersion returns the major version from a version such as
+// 'v6.5.0' or '2.8.3', 0 if unknown
+func xmrigMajorVersion(version string) int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return 0
+	}
+	return major
 }
 
 // writeConfig writes the config to the drive
-func (miner *Xmrig) writeConfig(config xmrigCPUConfigSpec) error {
+func (miner *Xmrig) writeConfig(config interface{}) error {
 	configFile, err := os.OpenFile(
 		miner.configPath,
 		os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
@@ -364,7 +504,8 @@ func (miner *Xmrig) writeConfig(config xmrigCPUConfigSpec) error {
 	return nil
 }
 
-// generateDefaultCPUConfig creates a config with some sane defaults
+// generateDefaultCPUConfig creates a config with some sane defaults, the
+// caller must hold configMutex
 func (miner *Xmrig) generateDefaultCPUConfig() (xmrigCPUConfigSpec, error) {
 	config := xmrigCPUConfigSpec{}
 
@@ -375,6 +516,7 @@ func (miner *Xmrig) generateDefaultCPUConfig() (xmrigCPUConfigSpec, error) {
 
 	miner.apiPort = port
 	config.API.Port = port
+	config.API.AccessToken = miner.accessToken
 	config.API.Ipv6 = false
 	config.API.Restricted = true
 	config.Asm = "auto"
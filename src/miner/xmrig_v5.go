@@ -0,0 +1,424 @@
+/*
+  MiningHQ Miner Controller - manages cryptocurrency miners on a user's machine.
+  https://mininghq.io
+
+	Copyright (C) 2018  Donovan Solms     <https://github.com/donovansolms>
+                                        <https://github.com/mininghq>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package miner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/phayes/freeport"
+)
+
+// xmrig 5 moved the CPU settings into a 'cpu' object with thread profiles
+// per algorithm family, the algorithm into the pools and the API into an
+// 'http' block. The API moved to /2/summary and /2/backends
+
+type xmrigV5Pool struct {
+	Algo           string      `json:"algo,omitempty"`
+	URL            string      `json:"url"`
+	User           string      `json:"user"`
+	Pass           string      `json:"pass"`
+	RigID          interface{} `json:"rig-id"`
+	Nicehash       bool        `json:"nicehash"`
+	Keepalive      bool        `json:"keepalive"`
+	Enabled        bool        `json:"enabled"`
+	TLS            bool        `json:"tls"`
+	TLSFingerprint interface{} `json:"tls-fingerprint"`
+	Daemon         bool        `json:"daemon"`
+}
+
+// xmrigV5ConfigSpec contains the options to write to the xmrig 5+ JSON config
+type xmrigV5ConfigSpec struct {
+	API struct {
+		ID       interface{} `json:"id"`
+		WorkerID interface{} `json:"worker-id"`
+	} `json:"api"`
+	HTTP struct {
+		Enabled     bool        `json:"enabled"`
+		Host        string      `json:"host"`
+		Port        int         `json:"port"`
+		AccessToken interface{} `json:"access-token"`
+		Restricted  bool        `json:"restricted"`
+	} `json:"http"`
+	Autosave   bool `json:"autosave"`
+	Background bool `json:"background"`
+	Colors     bool `json:"colors"`
+	RandomX    struct {
+		Init int    `json:"init"`
+		Mode string `json:"mode"`
+		NUMA bool   `json:"numa"`
+	} `json:"randomx"`
+	CPU struct {
+		Enabled   bool        `json:"enabled"`
+		HugePages bool        `json:"huge-pages"`
+		HwAes     interface{} `json:"hw-aes"`
+		Priority  interface{} `json:"priority"`
+		Asm       bool        `json:"asm"`
+		Yield     bool        `json:"yield"`
+		// Profiles maps the algorithm family to the thread affinities,
+		// -1 lets the OS schedule the thread
+		Profiles map[string][]int `json:"-"`
+	} `json:"cpu"`
+	OpenCL struct {
+		Enabled bool `json:"enabled"`
+	} `json:"opencl"`
+	CUDA struct {
+		Enabled bool `json:"enabled"`
+	} `json:"cuda"`
+	DonateLevel int           `json:"donate-level"`
+	LogFile     interface{}   `json:"log-file"`
+	Pools       []xmrigV5Pool `json:"pools"`
+	PrintTime   int           `json:"print-time"`
+	Retries     int           `json:"retries"`
+	RetryPause  int           `json:"retry-pause"`
+	Syslog      bool          `json:"syslog"`
+	UserAgent   interface{}   `json:"user-agent"`
+	Watch       bool          `json:"watch"`
+}
+
+// MarshalJSON adds the thread profiles into the cpu object, they share
+// the object with the fixed CPU options
+func (config xmrigV5ConfigSpec) MarshalJSON() ([]byte, error) {
+	// The alias type doesn't have the MarshalJSON method
+	type configAlias xmrigV5ConfigSpec
+	configBytes, err := json.Marshal(configAlias(config))
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]interface{}
+	err = json.Unmarshal(configBytes, &document)
+	if err != nil {
+		return nil, err
+	}
+	cpu := document["cpu"].(map[string]interface{})
+	for family, affinities := range config.CPU.Profiles {
+		cpu[family] = affinities
+	}
+	return json.Marshal(document)
+}
+
+// xmrigV5SummaryResponse is returned from the xmrig 5+ /2/summary endpoint
+type xmrigV5SummaryResponse struct {
+	ID       string `json:"id"`
+	WorkerID string `json:"worker_id"`
+	Uptime   int    `json:"uptime"`
+	Version  string `json:"version"`
+	Kind     string `json:"kind"`
+	Ua       string `json:"ua"`
+	CPU      struct {
+		Brand   string `json:"brand"`
+		Aes     bool   `json:"aes"`
+		X64     bool   `json:"x64"`
+		Cores   int    `json:"cores"`
+		Threads int    `json:"threads"`
+	} `json:"cpu"`
+	Algo        string `json:"algo"`
+	Paused      bool   `json:"paused"`
+	DonateLevel int    `json:"donate_level"`
+	// Hugepages is a bool in xmrig 5 and [used, total] pages in xmrig 6
+	Hugepages interface{} `json:"hugepages"`
+	Hashrate  struct {
+		Total   []float64 `json:"total"`
+		Highest float64   `json:"highest"`
+	} `json:"hashrate"`
+	Results struct {
+		DiffCurrent uint64        `json:"diff_current"`
+		SharesGood  uint32        `json:"shares_good"`
+		SharesTotal uint32        `json:"shares_total"`
+		AvgTime     int           `json:"avg_time"`
+		HashesTotal uint64        `json:"hashes_total"`
+		Best        []uint64      `json:"best"`
+		ErrorLog    []interface{} `json:"error_log"`
+	} `json:"results"`
+	Connection struct {
+		Pool     string        `json:"pool"`
+		IP       string        `json:"ip"`
+		Uptime   int           `json:"uptime"`
+		Ping     int           `json:"ping"`
+		Failures int           `json:"failures"`
+		TLS      interface{}   `json:"tls"`
+		Algo     string        `json:"algo"`
+		Diff     uint64        `json:"diff"`
+		Accepted uint32        `json:"accepted"`
+		Rejected uint32        `json:"rejected"`
+		ErrorLog []interface{} `json:"error_log"`
+	} `json:"connection"`
+}
+
+// xmrigV5Backend is a single entry returned from the xmrig 5+
+// /2/backends endpoint
+type xmrigV5Backend struct {
+	Type     string    `json:"type"`
+	Enabled  bool      `json:"enabled"`
+	Algo     string    `json:"algo"`
+	Profile  string    `json:"profile"`
+	Hashrate []float64 `json:"hashrate"`
+	Threads  []struct {
+		Affinity int       `json:"affinity"`
+		Hashrate []float64 `json:"hashrate"`
+	} `json:"threads"`
+}
+
+// configureV5 writes the xmrig 5+ config, the caller must hold configMutex
+func (miner *Xmrig) configureV5(config rpcproto.MinerConfig) error {
+	cpuConfig, err := miner.buildV5Config(config)
+	if err != nil {
+		return err
+	}
+	return miner.writeConfig(cpuConfig)
+}
+
+// buildV5Config creates the xmrig 5+ config for the assignment config, the
+// caller must hold configMutex
+func (miner *Xmrig) buildV5Config(config rpcproto.MinerConfig) (xmrigV5ConfigSpec, error) {
+	cpuConfig, err := miner.generateDefaultV5Config()
+	if err != nil {
+		return cpuConfig, fmt.Errorf("unable to create config: %s", err)
+	}
+
+	pools, err := poolConfigs(config)
+	if err != nil {
+		return cpuConfig, err
+	}
+	algorithm := ""
+	for _, pool := range pools {
+		poolAlgorithm := xmrigV5Algorithm(config.Algorithm, pool.Variant)
+		if algorithm == "" {
+			algorithm = poolAlgorithm
+		}
+		xmrigPool := xmrigV5Pool{
+			Algo:      poolAlgorithm,
+			URL:       pool.Endpoint,
+			User:      pool.Username,
+			Pass:      pool.Password,
+			Nicehash:  pool.Nicehash,
+			Keepalive: pool.Keepalive,
+			Enabled:   true,
+			TLS:       pool.TLS,
+		}
+		// xmrig expects null when these are not set
+		if pool.RigID != "" {
+			xmrigPool.RigID = pool.RigID
+		}
+		if pool.TLSFingerprint != "" {
+			xmrigPool.TLSFingerprint = pool.TLSFingerprint
+		}
+		cpuConfig.Pools = append(cpuConfig.Pools, xmrigPool)
+	}
+
+	// Only the profile for the assigned algorithm family is set, the
+	// thread count is what MiningHQ assigned
+	var affinities []int
+	for i := 0; i < int(config.CPUConfig.ThreadCount); i++ {
+		affinities = append(affinities, -1)
+	}
+	cpuConfig.CPU.Profiles = map[string][]int{
+		xmrigV5AlgorithmFamily(algorithm): affinities,
+	}
+	return cpuConfig, nil
+}
+
+// Reconfigure applies the new pool and thread config to the running
+// miner through the API, the config file is updated for restarts. Only
+// xmrig 5+ supports it
+func (miner *Xmrig) Reconfigure(config rpcproto.MinerConfig) error {
+	// Reconfiguring must not interleave with rewriting the config
+	// before a restart
+	miner.configMutex.Lock()
+	defer miner.configMutex.Unlock()
+	if miner.schemaVersion < 5 {
+		return ErrNotSupported
+	}
+	if config.Key != miner.key {
+		return fmt.Errorf("config for miner %s can't be applied to %s", config.Key, miner.key)
+	}
+	err := validateXmrigConfig(config)
+	if err != nil {
+		return err
+	}
+	cpuConfig, err := miner.buildV5Config(config)
+	if err != nil {
+		return err
+	}
+
+	if miner.process.pid() != 0 {
+		err = putJSON(
+			fmt.Sprintf("http://127.0.0.1:%d/1/config", miner.apiPort),
+			miner.accessToken,
+			cpuConfig)
+		if err != nil {
+			return fmt.Errorf("unable to apply config through the API: %s", err)
+		}
+	}
+	miner.config = config
+	return miner.writeConfig(cpuConfig)
+}
+
+// getStatsV5 returns the mining stats from the xmrig 5+ API
+func (miner *Xmrig) getStatsV5(apiPort int) (rpcproto.MinerStats, error) {
+	var stats rpcproto.MinerStats
+
+	var summary xmrigV5SummaryResponse
+	err := miner.getAPI(apiPort, "/2/summary", &summary)
+	if err != nil {
+		return stats, err
+	}
+	var backends []xmrigV5Backend
+	err = miner.getAPI(apiPort, "/2/backends", &backends)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Key = miner.key
+	// The hashrate windows are empty right after starting
+	if len(summary.Hashrate.Total) > 0 {
+		stats.Hashrate = summary.Hashrate.Total[0]
+	}
+	if len(summary.Hashrate.Total) > 1 {
+		stats.Hashrate60S = summary.Hashrate.Total[1]
+	}
+	if len(summary.Hashrate.Total) > 2 {
+		stats.Hashrate15M = summary.Hashrate.Total[2]
+	}
+	stats.MaxHashrate = summary.Hashrate.Highest
+	stats.TotalHashes = summary.Results.HashesTotal
+	stats.CurrentDifficulty = summary.Results.DiffCurrent
+	stats.TotalShares = summary.Results.SharesTotal
+	stats.AcceptedShares = summary.Results.SharesGood
+	stats.AverageShareTime = uint32(summary.Results.AvgTime)
+	stats.BestShares = summary.Results.Best
+	stats.Pool = summary.Connection.Pool
+	stats.PoolPing = uint32(summary.Connection.Ping)
+	stats.PoolUptime = uint64(summary.Connection.Uptime)
+	stats.PoolFailures = uint32(summary.Connection.Failures)
+	stats.PoolErrors = errorLogMessages(summary.Connection.ErrorLog)
+	if stats.TotalShares >= stats.AcceptedShares {
+		stats.RejectedShares = stats.TotalShares - stats.AcceptedShares
+	}
+
+	for _, backend := range backends {
+		if backend.Type != "cpu" || !backend.Enabled {
+			continue
+		}
+		cpuStats := rpcproto.CPUStats{}
+		for _, thread := range backend.Threads {
+			if len(thread.Hashrate) > 0 {
+				cpuStats.ThreadsHashrate = append(cpuStats.ThreadsHashrate, thread.Hashrate[0])
+			}
+		}
+		stats.CPUs = append(stats.CPUs, &cpuStats)
+	}
+	return stats, nil
+}
+
+// getAPI decodes the JSON response from the xmrig HTTP API path
+func (miner *Xmrig) getAPI(apiPort int, path string, response interface{}) error {
+	return getStatsJSON(
+		fmt.Sprintf("http://127.0.0.1:%d%s", apiPort, path),
+		miner.accessToken,
+		response)
+}
+
+// generateDefaultV5Config creates a xmrig 5+ config with some sane
+// defaults, the caller must hold configMutex
+func (miner *Xmrig) generateDefaultV5Config() (xmrigV5ConfigSpec, error) {
+	config := xmrigV5ConfigSpec{}
+
+	// The port is kept when reconfiguring, the API must stay reachable
+	if miner.apiPort == 0 {
+		port, err := freeport.GetFreePort()
+		if err != nil {
+			return config, err
+		}
+		miner.apiPort = port
+	}
+	config.HTTP.Enabled = true
+	config.HTTP.Host = "127.0.0.1"
+	config.HTTP.Port = miner.apiPort
+	config.HTTP.AccessToken = miner.accessToken
+	// Pause and resume need the unrestricted API, it only listens on
+	// localhost and requires the access token
+	config.HTTP.Restricted = false
+	config.Autosave = false
+	// TODO: update this to hide the miner
+	config.Background = false
+	config.Colors = true
+	config.RandomX.Init = -1
+	config.RandomX.Mode = "auto"
+	config.RandomX.NUMA = true
+	config.CPU.Enabled = true
+	config.CPU.HugePages = true
+	config.CPU.Asm = true
+	config.CPU.Yield = true
+	// MiningHQ only assigns CPU configs at the moment
+	config.OpenCL.Enabled = false
+	config.CUDA.Enabled = false
+	config.DonateLevel = 4
+	config.PrintTime = 60
+	config.Retries = 5
+	config.RetryPause = 5
+	config.Syslog = false
+	// Reconfigure applies changes through the API, watching the file
+	// would reload the same config twice
+	config.Watch = false
+	return config, nil
+}
+
+// xmrigV5Algorithm maps the MiningHQ algorithm and variant to the
+// xmrig 5+ algorithm name, ex. 'cryptonight' variant '2' is 'cn/2'
+func xmrigV5Algorithm(algorithm string, variant string) string {
+	algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+	variant = strings.ToLower(strings.TrimSpace(variant))
+	if strings.Contains(algorithm, "/") {
+		// Already a xmrig 5+ algorithm
+		return algorithm
+	}
+
+	family := algorithm
+	switch algorithm {
+	case "cryptonight", "cn":
+		family = "cn"
+	case "cryptonight-lite", "cn-lite":
+		family = "cn-lite"
+	case "cryptonight-heavy", "cn-heavy":
+		family = "cn-heavy"
+	case "cryptonight-pico", "cn-pico":
+		family = "cn-pico"
+	case "randomx", "rx":
+		family = "rx"
+		if variant == "" || variant == "-1" {
+			variant = "0"
+		}
+	}
+	if variant == "" || variant == "-1" {
+		return family
+	}
+	return family + "/" + variant
+}
+
+// xmrigV5AlgorithmFamily returns the thread profile name for the
+// algorithm, ex. 'rx/0' is 'rx'
+func xmrigV5AlgorithmFamily(algorithm string) string {
+	return strings.SplitN(algorithm, "/", 2)[0]
+}
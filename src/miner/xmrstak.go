@@ -22,21 +22,19 @@
 package miner
 
 import (
-	"bufio"
-	"container/list"
+	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
-	"sync"
 	"time"
 
 	unattended "github.com/ProjectLimitless/go-unattended"
 	"github.com/mininghq/miner-controller/src/conf"
 	"github.com/mininghq/rpcproto/rpcproto"
+	"github.com/phayes/freeport"
 	"github.com/sirupsen/logrus"
 )
 
@@ -44,22 +42,126 @@ import (
 type XmrStak struct {
 	// configPath might differ from the miner's location due to
 	// how MiningHQ's split mining is implemented
-	configPath    string
+	configPath string
+	// poolsPath and cpuPath are derived from the configPath since
+	// xmr-stak splits its configuration over multiple files
+	poolsPath     string
+	cpuPath       string
 	withUpdate    bool
 	updateWrapper *unattended.Unattended
-	errorHandler  func(string, string)
+	process       *minerProcess
+	*minerOutput
+
+	key     string
+	apiPort int
+	// apiLogin and apiPassword protect the httpd API, xmr-stak listens
+	// on all interfaces
+	apiLogin    string
+	apiPassword string
+}
+
+// xmrStakConfigSpec contains the options to write to the xmr-stak config.txt
+type xmrStakConfigSpec struct {
+	CallTimeout   int         `json:"call_timeout"`
+	RetryTime     int         `json:"retry_time"`
+	GiveupLimit   int         `json:"giveup_limit"`
+	VerboseLevel  int         `json:"verbose_level"`
+	PrintMotd     bool        `json:"print_motd"`
+	HPrintTime    int         `json:"h_print_time"`
+	AesOverride   interface{} `json:"aes_override"`
+	UseSlowMemory string      `json:"use_slow_memory"`
+	TLSSecureAlgo bool        `json:"tls_secure_algo"`
+	DaemonMode    bool        `json:"daemon_mode"`
+	FlushStdout   bool        `json:"flush_stdout"`
+	OutputFile    string      `json:"output_file"`
+	HttpdPort     int         `json:"httpd_port"`
+	HTTPLogin     string      `json:"http_login"`
+	HTTPPass      string      `json:"http_pass"`
+	PreferIpv4    bool        `json:"prefer_ipv4"`
+}
+
+type xmrStakPool struct {
+	PoolAddress    string `json:"pool_address"`
+	WalletAddress  string `json:"wallet_address"`
+	RigID          string `json:"rig_id"`
+	PoolPassword   string `json:"pool_password"`
+	UseNicehash    bool   `json:"use_nicehash"`
+	UseTLS         bool   `json:"use_tls"`
+	TLSFingerprint string `json:"tls_fingerprint"`
+	PoolWeight     int    `json:"pool_weight"`
+}
+
+// xmrStakPoolsSpec contains the options to write to the xmr-stak pools.txt
+type xmrStakPoolsSpec struct {
+	PoolList []xmrStakPool `json:"pool_list"`
+	Currency string        `json:"currency"`
+}
 
-	key      string
-	apiPort  int
-	logList  *list.List
-	logMax   int
-	logMutex sync.Mutex
+type xmrStakCPUThread struct {
+	LowPowerMode bool        `json:"low_power_mode"`
+	NoPrefetch   bool        `json:"no_prefetch"`
+	Asm          string      `json:"asm"`
+	AffineToCPU  interface{} `json:"affine_to_cpu"`
+}
+
+// xmrStakCPUSpec contains the options to write to the xmr-stak cpu.txt
+type xmrStakCPUSpec struct {
+	CPUThreadsConf []xmrStakCPUThread `json:"cpu_threads_conf"`
+}
+
+// xmrStakAPIResponse is returned from the xmr-stak /api.json endpoint
+type xmrStakAPIResponse struct {
+	Version  string `json:"version"`
+	Hashrate struct {
+		Threads [][]float64 `json:"threads"`
+		Total   []float64   `json:"total"`
+		Highest float64     `json:"highest"`
+	} `json:"hashrate"`
+	Results struct {
+		DiffCurrent uint64   `json:"diff_current"`
+		SharesGood  uint32   `json:"shares_good"`
+		SharesTotal uint32   `json:"shares_total"`
+		AvgTime     float64  `json:"avg_time"`
+		HashesTotal uint64   `json:"hashes_total"`
+		Best        []uint64 `json:"best"`
+		ErrorLog    []struct {
+			Count    int    `json:"count"`
+			LastSeen int    `json:"last_seen"`
+			Text     string `json:"text"`
+		} `json:"error_log"`
+	} `json:"results"`
+	Connection struct {
+		Pool     string `json:"pool"`
+		Uptime   int    `json:"uptime"`
+		Ping     int    `json:"ping"`
+		ErrorLog []struct {
+			LastSeen int    `json:"last_seen"`
+			Text     string `json:"text"`
+		} `json:"error_log"`
+	} `json:"connection"`
+}
+
+func init() {
+	Register("xmr-stak", func(
+		withUpdate bool,
+		basePath string,
+		configPath string,
+		config rpcproto.MinerConfig) (Miner, error) {
+		miner, err := NewXmrStak(withUpdate, basePath, configPath, config)
+		if miner == nil {
+			// Avoid returning a typed nil as a Miner
+			return nil, err
+		}
+		return miner, err
+	})
+	RegisterValidator("xmr-stak", validateXmrStakConfig)
 }
 
 // NewXmrStak creates a new instance of the xmr-stak miner
 //
 // It takes the unattended base path, the path to use for the config
-// and the configuration to use
+// and the configuration to use. The pools and cpu config files are written
+// next to the config path
 //
 // We configure the miner at construction
 func NewXmrStak(
@@ -68,54 +170,70 @@ func NewXmrStak(
 	configPath string,
 	config rpcproto.MinerConfig) (*XmrStak, error) {
 
-	// Setup the logging, by default we log to stdout
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp:   true,
-		TimestampFormat: "Jan 02 15:04:05",
-	})
-	logrus.SetLevel(logrus.InfoLevel)
-	// TODO: Debug?
-	logrus.SetLevel(logrus.DebugLevel)
-
-	logrus.SetOutput(os.Stdout)
-
 	log := logrus.WithFields(logrus.Fields{
 		"service": "unattended",
 	})
 	log.Info("Setting up Unattended updates")
 
+	// config.0.json becomes config.0.pools.txt and config.0.cpu.txt
+	configBase := strings.TrimSuffix(configPath, filepath.Ext(configPath))
+	apiPassword, err := generateAccessToken()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate API password: %s", err)
+	}
 	xmrStak := XmrStak{
-		key:        config.Key,
-		withUpdate: withUpdate,
-		configPath: configPath,
-		logList:    list.New(),
-		logMax:     100,
+		apiLogin:    "mininghq",
+		apiPassword: apiPassword,
+		key:         config.Key,
+		withUpdate:  withUpdate,
+		configPath:  configPath,
+		poolsPath:   configBase + ".pools.txt",
+		cpuPath:     configBase + ".cpu.txt",
+		minerOutput: newMinerOutput(config.Key, &xmrStakOutputParser{}),
 	}
-	err := xmrStak.configure(config)
-	if err != nil {
-		log.Errorf("Unable to configure miner: %s", err.Error())
-		return nil, err
+	parameters := []string{
+		"--config",
+		xmrStak.configPath,
+		"--poolconf",
+		xmrStak.poolsPath,
+		"--cpu",
+		xmrStak.cpuPath,
+		// MiningHQ only assigns CPU configs at the moment
+		"--noAMD",
+		"--noNVIDIA",
+	}
+	if runtime.GOOS == "windows" {
+		// Don't prompt for elevation, we're running in the background
+		parameters = append(parameters, "--noUAC")
 	}
 
+	target := unattended.Target{
+		VersionsPath:          basePath,
+		AppID:                 fmt.Sprintf("xmr-stak-%s", strings.ToLower(runtime.GOOS)),
+		UpdateEndpoint:        conf.UnattendedBaseURL,
+		UpdateChannel:         "stable",
+		ApplicationName:       "xmr-stak",
+		ApplicationParameters: parameters,
+	}
 	xmrStak.updateWrapper, err = unattended.New(
 		"TEST001", // TODO clientID - miner key?
-		unattended.Target{ // target
-			VersionsPath:    basePath,
-			AppID:           fmt.Sprintf("xmr-stak-%s", strings.ToLower(runtime.GOOS)),
-			UpdateEndpoint:  conf.UnattendedBaseURL,
-			UpdateChannel:   "stable",
-			ApplicationName: "xmr-stak",
-			ApplicationParameters: []string{
-				"--config",
-				configPath,
-			},
-		},
+		target,
 		time.Hour, // UpdateCheckInterval
 		log,
 	)
 	if err != nil {
 		return nil, err
 	}
+
+	// The config files are written last, nothing may fail after this
+	// that would leave them behind
+	err = xmrStak.configure(config)
+	if err != nil {
+		log.Errorf("Unable to configure miner: %s", err.Error())
+		xmrStak.removeConfigs()
+		return nil, err
+	}
+	xmrStak.process = newMinerProcess(xmrStak.updateWrapper, withUpdate, target, log)
 	if xmrStak.withUpdate {
 		// During construction we check for any updates as well, this has the
 		// side effect that *if* the miner doesn't exist yet, it will be downloaded
@@ -131,77 +249,116 @@ func (miner *XmrStak) configure(config rpcproto.MinerConfig) error {
 	if config.CPUConfig == nil {
 		return fmt.Errorf("You must provide a CPUConfig for xmr-stak")
 	}
+	pools, err := poolConfigs(config)
+	if err != nil {
+		return err
+	}
+
+	mainConfig, err := miner.generateDefaultConfig()
+	if err != nil {
+		return fmt.Errorf("unable to create config: %s", err)
+	}
+
+	poolsConfig := xmrStakPoolsSpec{
+		Currency: miner.currencyForAlgorithm(
+			config.Algorithm,
+			pools[0].Variant),
+	}
+	for i, pool := range pools {
+		poolsConfig.PoolList = append(poolsConfig.PoolList, xmrStakPool{
+			PoolAddress:    pool.Endpoint,
+			WalletAddress:  pool.Username,
+			RigID:          pool.RigID,
+			PoolPassword:   pool.Password,
+			UseNicehash:    pool.Nicehash,
+			UseTLS:         pool.TLS,
+			TLSFingerprint: pool.TLSFingerprint,
+			// xmr-stak prefers the pool with the highest weight
+			PoolWeight: len(pools) - i,
+		})
+	}
+
+	cpuConfig := xmrStakCPUSpec{}
+	for i := 0; i < int(config.CPUConfig.ThreadCount); i++ {
+		cpuConfig.CPUThreadsConf = append(
+			cpuConfig.CPUThreadsConf,
+			xmrStakCPUThread{
+				LowPowerMode: false,
+				NoPrefetch:   true,
+				Asm:          "auto",
+				// Let the OS schedule the threads
+				AffineToCPU: false,
+			})
+	}
+
+	err = miner.writeConfig(miner.configPath, mainConfig)
+	if err != nil {
+		return err
+	}
+	err = miner.writeConfig(miner.poolsPath, poolsConfig)
+	if err != nil {
+		return err
+	}
+	return miner.writeConfig(miner.cpuPath, cpuConfig)
+}
 
-	// cpuConfig, err := miner.generateDefaultCPUConfig()
-	// if err != nil {
-	// 	return fmt.Errorf("unable to create config: %s", err)
-	// }
-	// cpuConfig.Threads = int(config.CPUConfig.ThreadCount)
-	// cpuConfig.Algo = config.Algorithm
-	// cpuConfig.Pools = []xmrigPool{
-	// 	{
-	// 		URL:     config.PoolConfig.Endpoint,
-	// 		User:    config.PoolConfig.Username,
-	// 		Pass:    config.PoolConfig.Password,
-	// 		Variant: config.PoolConfig.Variant,
-	// 	},
-	// }
-	// return miner.writeConfig(cpuConfig)
+// validateXmrStakConfig checks the config can be used with xmr-stak, it
+// only supports the CryptoNight algorithms
+func validateXmrStakConfig(config rpcproto.MinerConfig) error {
+	if config.CPUConfig == nil {
+		return fmt.Errorf("You must provide a CPUConfig for xmr-stak")
+	}
+	algorithm := strings.ToLower(strings.TrimSpace(config.Algorithm))
+	family := xmrigV5AlgorithmFamily(xmrigV5Algorithm(algorithm, ""))
+	switch {
+	case family == "cn", family == "cn-lite", family == "cn-heavy":
+	case strings.HasPrefix(algorithm, "cryptonight"):
+	default:
+		return fmt.Errorf("Unknown algorithm '%s' for xmr-stak", config.Algorithm)
+	}
 	return nil
 }
 
 // Start xmr-stak
 func (miner *XmrStak) Start() error {
 
-	if miner.errorHandler == nil {
-		return errors.New("error handler is nil, it must be set using SetErrorHandler")
-	}
-
-	// Setup the reading of the output
-	outputReader, outputWriter := io.Pipe()
-	miner.updateWrapper.SetOutputWriter(outputWriter)
-	//miner.updateWrapper.SetOutputWriter(os.Stdout)
-	go func() {
-		scanner := bufio.NewScanner(outputReader)
-		for scanner.Scan() {
-			miner.logMutex.Lock()
-			miner.logList.PushBack(scanner.Text())
-			if miner.logList.Len() >= miner.logMax {
-				miner.logList.Remove(miner.logList.Front())
-			}
-			miner.logMutex.Unlock()
-
-			// Check if we got any errors
-			// We do it by reading the logs because errors are not *always*
-			// available via an API
-			if strings.Contains(strings.ToLower(scanner.Text()), "error") ||
-				strings.Contains(strings.ToLower(scanner.Text()), "invalid") {
-				miner.errorHandler(miner.GetKey(), scanner.Text())
-			}
-		}
-	}()
-
-	if miner.withUpdate {
-		//Check for and apply updates first
-		miner.updateWrapper.ApplyUpdates()
-		return miner.updateWrapper.Run()
+	outputWriter, err := miner.readOutput()
+	if err != nil {
+		return err
 	}
-	return miner.updateWrapper.RunWithoutUpdate()
-}
-
-// SetErrorHandler sets the handler to send any errors to
-// It takes the miner key and the string containing the error
-func (miner *XmrStak) SetErrorHandler(errorHandler func(string, string)) {
-	miner.errorHandler = errorHandler
+	return miner.process.run(outputWriter)
 }
 
 // Stop the miner and remove the config files
 func (miner *XmrStak) Stop() error {
-	err := miner.updateWrapper.Stop()
+	err := miner.process.stop(conf.MinerStopTimeout)
 	if err != nil {
 		return err
 	}
-	return os.Remove(miner.configPath)
+	return miner.removeConfigs()
+}
+
+// removeConfigs removes the config files, missing files are ignored
+func (miner *XmrStak) removeConfigs() error {
+	for _, path := range []string{miner.configPath, miner.poolsPath, miner.cpuPath} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update installs a new version of xmr-stak if one is available
+func (miner *XmrStak) Update() error {
+	return miner.process.applyUpdate()
+}
+
+// Health returns the actual state of the miner
+func (miner *XmrStak) Health() Health {
+	health := miner.process.health(miner.configPath, miner.poolsPath, miner.cpuPath)
+	health.APIPort = miner.apiPort
+	return health
 }
 
 // GetType returns the miner type
@@ -214,52 +371,59 @@ func (miner *XmrStak) GetKey() string {
 	return miner.key
 }
 
-// GetStats returns the mining stats in a uniform format from xmrig
+// GetStats returns the mining stats in a uniform format from xmr-stak
 func (miner *XmrStak) GetStats() (rpcproto.MinerStats, error) {
 
 	var stats rpcproto.MinerStats
 
-	// response, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d", miner.apiPort))
-	// if err != nil {
-	// 	return stats, err
-	// }
-	//
-	// var xmrigStats xmrigAPIResponse
-	// err = json.NewDecoder(response.Body).Decode(&xmrigStats)
-	// if err != nil {
-	// 	return stats, err
-	// }
-	// stats.Key = miner.key
-	// stats.Hashrate = xmrigStats.Hashrate.Total[0]
-	// stats.MaxHashrate = xmrigStats.Hashrate.Highest
-	// stats.TotalHashes = xmrigStats.Results.HashesTotal
-	// stats.CurrentDifficulty = xmrigStats.Results.DiffCurrent
-	// stats.TotalShares = xmrigStats.Results.SharesTotal
-	// stats.AcceptedShares = xmrigStats.Results.SharesGood
-	// stats.RejectedShares = stats.TotalShares - stats.AcceptedShares
-	//
-	// cpuStats := rpcproto.CPUStats{}
-	// for _, thread := range xmrigStats.Hashrate.Threads {
-	// 	if len(thread) > 0 {
-	// 		cpuStats.ThreadsHashrate = append(cpuStats.ThreadsHashrate, thread[0])
-	// 	}
-	// }
-	// stats.CPUs = append(stats.CPUs, &cpuStats)
-	return stats, nil
-}
-
-// GetLogs returns the last logs from the actual miner
-func (miner *XmrStak) GetLogs() []string {
-	// Get all the logs and return them in the current order
-	miner.logMutex.Lock()
-	defer miner.logMutex.Unlock()
+	// xmr-stak only supports digest authentication
+	var xmrStakStats xmrStakAPIResponse
+	err := getStatsJSONDigest(
+		fmt.Sprintf("http://127.0.0.1:%d/api.json", miner.apiPort),
+		miner.apiLogin,
+		miner.apiPassword,
+		&xmrStakStats)
+	if err != nil {
+		return stats, err
+	}
+	stats.Key = miner.key
+	// The hashrate windows are null until enough samples were taken
+	if len(xmrStakStats.Hashrate.Total) > 0 {
+		stats.Hashrate = xmrStakStats.Hashrate.Total[0]
+	}
+	if len(xmrStakStats.Hashrate.Total) > 1 {
+		stats.Hashrate60S = xmrStakStats.Hashrate.Total[1]
+	}
+	if len(xmrStakStats.Hashrate.Total) > 2 {
+		stats.Hashrate15M = xmrStakStats.Hashrate.Total[2]
+	}
+	stats.MaxHashrate = xmrStakStats.Hashrate.Highest
+	stats.TotalHashes = xmrStakStats.Results.HashesTotal
+	stats.CurrentDifficulty = xmrStakStats.Results.DiffCurrent
+	stats.TotalShares = xmrStakStats.Results.SharesTotal
+	stats.AcceptedShares = xmrStakStats.Results.SharesGood
+	stats.AverageShareTime = uint32(xmrStakStats.Results.AvgTime)
+	stats.BestShares = xmrStakStats.Results.Best
+	stats.Pool = xmrStakStats.Connection.Pool
+	stats.PoolPing = uint32(xmrStakStats.Connection.Ping)
+	stats.PoolUptime = uint64(xmrStakStats.Connection.Uptime)
+	// xmr-stak doesn't count failures, we count the logged errors
+	stats.PoolFailures = uint32(len(xmrStakStats.Connection.ErrorLog))
+	for _, poolError := range xmrStakStats.Connection.ErrorLog {
+		stats.PoolErrors = append(stats.PoolErrors, poolError.Text)
+	}
+	if stats.TotalShares >= stats.AcceptedShares {
+		stats.RejectedShares = stats.TotalShares - stats.AcceptedShares
+	}
 
-	var logs []string
-	for item := miner.logList.Front(); item != nil; item = item.Next() {
-		log := item.Value.(string)
-		logs = append(logs, log)
+	cpuStats := rpcproto.CPUStats{}
+	for _, thread := range xmrStakStats.Hashrate.Threads {
+		if len(thread) > 0 {
+			cpuStats.ThreadsHashrate = append(cpuStats.ThreadsHashrate, thread[0])
+		}
 	}
-	return logs
+	stats.CPUs = append(stats.CPUs, &cpuStats)
+	return stats, nil
 }
 
 // GetVersion returns the latest version currently running
@@ -268,16 +432,26 @@ func (miner *XmrStak) GetVersion() string {
 }
 
 // writeConfig writes the config to the drive
-func (miner *XmrStak) writeConfig(config xmrigCPUConfigSpec) error {
+//
+// xmr-stak config files are the members of a JSON object without the
+// enclosing braces, so we encode the spec and strip them
+func (miner *XmrStak) writeConfig(path string, config interface{}) error {
+	configBytes, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	configBytes = bytes.TrimPrefix(configBytes, []byte("{"))
+	configBytes = bytes.TrimSuffix(configBytes, []byte("}"))
+
 	configFile, err := os.OpenFile(
-		miner.configPath,
+		path,
 		os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
 		0644)
 	if err != nil {
 		return err
 	}
 	defer configFile.Close()
-	err = json.NewEncoder(configFile).Encode(config)
+	_, err = configFile.Write(append(bytes.TrimSpace(configBytes), '\n'))
 	if err != nil {
 		return err
 	}
@@ -285,37 +459,62 @@ func (miner *XmrStak) writeConfig(config xmrigCPUConfigSpec) error {
 	return nil
 }
 
-// generateDefaultCPUConfig creates a config with some sane defaults
-// func (miner *XmrStak) generateDefaultCPUConfig() (xmrigCPUConfigSpec, error) {
-// 	config := xmrigCPUConfigSpec{}
-//
-// 	port, err := freeport.GetFreePort()
-// 	if err != nil {
-// 		return config, err
-// 	}
-//
-// 	miner.apiPort = port
-// 	config.API.Port = port
-// 	config.API.Ipv6 = false
-// 	config.API.Restricted = true
-// 	config.Asm = "auto"
-// 	config.Autosave = false
-// 	config.Av = 0
-// 	// TODO: update this to hide the miner
-// 	config.Background = false
-// 	config.Colors = true
-// 	config.DonateLevel = 4
-// 	config.HugePages = true
-// 	// TODO: Check if we pass this in the CPU config
-// 	config.HwAes = true
-// 	config.Algo = "cryptonight"
-// 	config.PrintTime = 60
-// 	config.Retries = 5
-// 	config.RetryPause = 5
-// 	config.Safe = false
-// 	config.Threads = 1
-// 	config.Syslog = false
-// 	// Watch is currently not supported in xmrig, only in xmrig-proxy
-// 	config.Watch = false
-// 	return config, nil
-// }
+// currencyForAlgorithm maps the MiningHQ algorithm and variant to the
+// xmr-stak currency setting
+func (miner *XmrStak) currencyForAlgorithm(algorithm string, variant string) string {
+	switch strings.ToLower(algorithm) {
+	case "cryptonight", "cn":
+		switch variant {
+		case "0":
+			return "cryptonight"
+		case "1":
+			return "cryptonight_v7"
+		case "2":
+			return "cryptonight_v8"
+		}
+		// Let xmr-stak follow the Monero forks
+		return "monero"
+	case "cryptonight-lite", "cn-lite":
+		if variant == "1" {
+			return "cryptonight_lite_v7"
+		}
+		return "cryptonight_lite"
+	case "cryptonight-heavy", "cn-heavy":
+		return "cryptonight_heavy"
+	}
+	return strings.Replace(strings.ToLower(algorithm), "-", "_", -1)
+}
+
+// generateDefaultConfig creates a config with some sane defaults
+func (miner *XmrStak) generateDefaultConfig() (xmrStakConfigSpec, error) {
+	config := xmrStakConfigSpec{}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		return config, err
+	}
+
+	miner.apiPort = port
+	config.HttpdPort = port
+	// The httpd listens on all interfaces, the API must not be open to
+	// the network
+	config.HTTPLogin = miner.apiLogin
+	config.HTTPPass = miner.apiPassword
+	config.CallTimeout = 10
+	config.RetryTime = 5
+	// Never give up, we'll keep retrying the pool
+	config.GiveupLimit = 0
+	config.VerboseLevel = 4
+	config.PrintMotd = false
+	config.HPrintTime = 60
+	// Let xmr-stak detect AES support
+	config.AesOverride = nil
+	config.UseSlowMemory = "warn"
+	config.TLSSecureAlgo = true
+	config.DaemonMode = true
+	// We read the output via a pipe, it must not be buffered
+	config.FlushStdout = true
+	config.OutputFile = ""
+	config.PreferIpv4 = true
+	return config, nil
+}